@@ -0,0 +1,298 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/weasel/internal"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Google Cloud Storage OAuth2 scopes.
+const scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// Backend provides access to bucket objects.
+// Storage retrieves all objects through a Backend, while caching
+// and serving them on its own.
+type Backend interface {
+	// Open retrieves object name of the bucket, including its body.
+	// The opts argument may be nil.
+	// The returned error should be of type *FetchError if the object
+	// cannot be retrieved, e.g. with Code 404 if it does not exist.
+	Open(ctx context.Context, bucket, name string, opts *OpenOptions) (*Object, error)
+
+	// Stat is similar to Open except the returned Object.Body may be nil.
+	Stat(ctx context.Context, bucket, name string) (*Object, error)
+
+	// List returns a single page of the bucket objects matching q.
+	List(ctx context.Context, bucket string, q *ListQuery) (*ObjectList, error)
+}
+
+// OpenOptions modify Backend.Open behavior.
+type OpenOptions struct {
+	// Range is an HTTP Range header value, e.g. "bytes=0-99".
+	// If the backend satisfies it, the returned Object.Body contains
+	// only the requested bytes and Object.Meta has a "content-range" entry.
+	// Otherwise, the whole object is returned.
+	// Unsatisfiable ranges result in a FetchError with Code 416.
+	Range string
+
+	// IfNoneMatch is an entity tag of a previously retrieved object.
+	// If the object still has the same etag, Open returns a FetchError
+	// with Code 304 instead of the object.
+	IfNoneMatch string
+}
+
+// ListQuery specifies which objects Backend.List returns.
+type ListQuery struct {
+	Prefix     string // list only names beginning with Prefix
+	Delimiter  string // roll up names containing Delimiter after Prefix into ObjectList.Prefixes
+	PageToken  string // ObjectList.NextPageToken of the previous page
+	MaxResults int    // max number of results per page; zero means backend default
+}
+
+// ObjectList is a single page of Backend.List results.
+type ObjectList struct {
+	Objects       []*ObjectAttrs
+	Prefixes      []string // rolled up names, ending with ListQuery.Delimiter
+	NextPageToken string   // empty if this is the last page
+}
+
+// ObjectAttrs contains attributes of a listed object.
+type ObjectAttrs struct {
+	Name        string
+	Size        int64
+	ContentType string
+	ETag        string
+	Updated     time.Time
+}
+
+// GCS is a Backend which retrieves objects from Google Cloud Storage.
+type GCS struct {
+	Base string // GCS service base URL, e.g. "https://storage.googleapis.com".
+
+	// Client is used to send requests to GCS.
+	// If nil, a client authorized with Google Application Default Credentials
+	// is created for each request.
+	Client *http.Client
+
+	// Headers are additional object headers propagated in Object.Meta,
+	// such as "content-language".
+	Headers []string
+}
+
+// Open implements Backend.Open using GCS XML API.
+func (g *GCS) Open(ctx context.Context, bucket, name string, opts *OpenOptions) (*Object, error) {
+	h := make(http.Header)
+	if opts != nil && opts.Range != "" {
+		h.Set("range", opts.Range)
+	}
+	if opts != nil && opts.IfNoneMatch != "" {
+		h.Set("if-none-match", opts.IfNoneMatch)
+	}
+	res, err := g.do(ctx, "GET", g.objectURL(bucket, name), h)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		return nil, &FetchError{Msg: res.Status, Code: res.StatusCode}
+	}
+	o := &Object{
+		Meta: g.objectMeta(res.Header),
+		Body: res.Body,
+		Size: res.ContentLength,
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		o.Meta["content-range"] = res.Header.Get("content-range")
+	}
+	return o, nil
+}
+
+// Stat implements Backend.Stat using GCS XML API.
+// The returned Object.Body is always nil.
+func (g *GCS) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	res, err := g.do(ctx, "HEAD", g.objectURL(bucket, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return &Object{Meta: g.objectMeta(res.Header), Size: res.ContentLength}, nil
+}
+
+// List implements Backend.List using GCS JSON API.
+func (g *GCS) List(ctx context.Context, bucket string, q *ListQuery) (*ObjectList, error) {
+	v := url.Values{}
+	v.Set("fields", "items(name,size,contentType,etag,updated),prefixes,nextPageToken")
+	if q.Prefix != "" {
+		v.Set("prefix", q.Prefix)
+	}
+	if q.Delimiter != "" {
+		v.Set("delimiter", q.Delimiter)
+	}
+	if q.PageToken != "" {
+		v.Set("pageToken", q.PageToken)
+	}
+	if q.MaxResults > 0 {
+		v.Set("maxResults", strconv.Itoa(q.MaxResults))
+	}
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.Base, url.PathEscape(bucket), v.Encode())
+	res, err := g.do(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var r io.Reader = res.Body
+	if res.Header.Get("content-encoding") == "gzip" {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+	var body struct {
+		Items []struct {
+			Name        string
+			Size        int64 `json:",string"`
+			ContentType string
+			ETag        string
+			Updated     time.Time
+		}
+		Prefixes      []string
+		NextPageToken string
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, err
+	}
+	l := &ObjectList{
+		Prefixes:      body.Prefixes,
+		NextPageToken: body.NextPageToken,
+	}
+	for _, it := range body.Items {
+		l.Objects = append(l.Objects, &ObjectAttrs{
+			Name:        it.Name,
+			Size:        it.Size,
+			ContentType: it.ContentType,
+			ETag:        it.ETag,
+			Updated:     it.Updated,
+		})
+	}
+	return l, nil
+}
+
+func (g *GCS) objectURL(bucket, name string) string {
+	return fmt.Sprintf("%s/%s", g.Base, path.Join(bucket, name))
+}
+
+// do sends an HTTP request to GCS with optional headers h.
+// The returned error will be of type FetchError if the storage responds
+// with an error code.
+func (g *GCS) do(ctx context.Context, method, url string, h http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Asking for gzip explicitly disables transparent decompression
+	// of the transport, so that objects stored with a content coding
+	// are kept intact and served with a matching content-encoding.
+	// Readers of the content decode them with Storage.OpenDecoded.
+	req.Header.Set("accept-encoding", "gzip")
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	res, err := g.client(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 399 {
+		// FetchError takes precedence over i/o errors
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, &FetchError{
+			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
+			Code: res.StatusCode,
+		}
+	}
+	return res, nil
+}
+
+// objectMeta returns a subset of h propagated from a GCS object:
+// objectHeaders, g.Headers and custom metadata of response headers.
+func (g *GCS) objectMeta(h http.Header) map[string]string {
+	m := make(map[string]string)
+	for _, k := range objectHeaders {
+		if v := h.Get(k); v != "" {
+			m[k] = v
+		}
+	}
+	for _, k := range g.Headers {
+		if v := h.Get(k); v != "" {
+			m[strings.ToLower(k)] = v
+		}
+	}
+	for k, v := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, metaHeaderPrefix) && len(v) > 0 {
+			m[k] = v[0]
+		}
+	}
+	return m
+}
+
+func (g *GCS) client(ctx context.Context) *http.Client {
+	if g.Client != nil {
+		return g.Client
+	}
+	return httpClient(ctx, scopeStorageRead)
+}
+
+// httpClient returns a client authorized with the scopes.
+// It uses URL Fetch service when running on App Engine standard.
+func httpClient(ctx context.Context, scopes ...string) *http.Client {
+	var base http.RoundTripper = http.DefaultTransport
+	if appengine.IsStandard() {
+		base = &urlfetch.Transport{Context: ctx}
+	}
+	t := &oauth2.Transport{
+		Source: internal.TokenSource(ctx, scopes...),
+		Base:   base,
+	}
+	return &http.Client{Transport: t}
+}
+
+// FetchError contains error code and message from a GCS response.
+type FetchError struct {
+	Msg  string
+	Code int
+}
+
+// Error returns formatted FetchError.
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("FetchError %d: %s", e.Code, e.Msg)
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memBackend is an in-memory Backend.
+type memBackend map[string]string
+
+func (m memBackend) Open(ctx context.Context, bucket, name string, opts *OpenOptions) (*Object, error) {
+	b, ok := m[bucket+"/"+name]
+	if !ok {
+		return nil, &FetchError{Msg: "not found", Code: http.StatusNotFound}
+	}
+	o := &Object{
+		Meta: map[string]string{"content-type": "text/plain"},
+		Body: ioutil.NopCloser(strings.NewReader(b)),
+		Size: int64(len(b)),
+	}
+	return o, nil
+}
+
+func (m memBackend) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	o, err := m.Open(ctx, bucket, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.Body = nil
+	return o, nil
+}
+
+func (m memBackend) List(ctx context.Context, bucket string, q *ListQuery) (*ObjectList, error) {
+	var names []string
+	for k := range m {
+		if strings.HasPrefix(k, bucket+"/"+q.Prefix) {
+			names = append(names, strings.TrimPrefix(k, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+	l := &ObjectList{}
+	for _, name := range names {
+		rest := strings.TrimPrefix(name, q.Prefix)
+		if i := strings.Index(rest, q.Delimiter); q.Delimiter != "" && i >= 0 {
+			p := q.Prefix + rest[:i+len(q.Delimiter)]
+			if n := len(l.Prefixes); n == 0 || l.Prefixes[n-1] != p {
+				l.Prefixes = append(l.Prefixes, p)
+			}
+			continue
+		}
+		l.Objects = append(l.Objects, &ObjectAttrs{Name: name, Size: int64(len(m[bucket+"/"+name]))})
+	}
+	return l, nil
+}
+
+func TestStorageBackend(t *testing.T) {
+	ctx := context.Background()
+	stor := &Storage{
+		Base:    "invalid", // make sure we don't hit real GCS
+		Index:   "index.html",
+		Backend: memBackend{"bucket/dir/index.html": "from backend"},
+		Cache:   NewLRU(1 << 20),
+	}
+	o, err := stor.OpenFile(ctx, "bucket", "dir/")
+	if err != nil {
+		t.Fatalf("stor.OpenFile: %v", err)
+	}
+	defer o.Body.Close()
+	b, _ := ioutil.ReadAll(o.Body)
+	if string(b) != "from backend" {
+		t.Errorf("o.Body = %q; want 'from backend'", b)
+	}
+
+	o, err = stor.OpenFile(ctx, "bucket", "dir")
+	if err != nil {
+		t.Fatalf("stor.OpenFile: %v", err)
+	}
+	if v := o.Redirect(); v != "/dir/" {
+		t.Errorf("o.Redirect() = %q; want /dir/", v)
+	}
+
+	_, err = stor.OpenFile(ctx, "bucket", "missing.txt")
+	if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusNotFound {
+		t.Errorf("stor.OpenFile(missing.txt): %v; want 404 FetchError", err)
+	}
+}
+
+func TestGCSList(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" {
+			t.Errorf("r.URL.Path = %q; want /storage/v1/b/bucket/o", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if v := q.Get("prefix"); v != "dir/" {
+			t.Errorf("prefix = %q; want dir/", v)
+		}
+		if v := q.Get("delimiter"); v != "/" {
+			t.Errorf("delimiter = %q; want /", v)
+		}
+		if v := q.Get("pageToken"); v != "token1" {
+			t.Errorf("pageToken = %q; want token1", v)
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{
+			"items": [{
+				"name": "dir/file.txt",
+				"size": "123",
+				"contentType": "text/plain",
+				"etag": "CJDa",
+				"updated": "2019-10-01T10:00:00.000Z"
+			}],
+			"prefixes": ["dir/sub/"],
+			"nextPageToken": "token2"
+		}`))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	g := &GCS{Base: ts.URL}
+	l, err := g.List(ctx, "bucket", &ListQuery{Prefix: "dir/", Delimiter: "/", PageToken: "token1"})
+	if err != nil {
+		t.Fatalf("g.List: %v", err)
+	}
+	want := &ObjectList{
+		Objects: []*ObjectAttrs{{
+			Name:        "dir/file.txt",
+			Size:        123,
+			ContentType: "text/plain",
+			ETag:        "CJDa",
+			Updated:     time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC),
+		}},
+		Prefixes:      []string{"dir/sub/"},
+		NextPageToken: "token2",
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("g.List = %+v; want %+v", l, want)
+	}
+}
+
+func TestGCSHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		w.Header().Set("content-language", "de")
+		w.Header().Set("x-goog-meta-header-x-frame-options", "DENY")
+		w.Header().Set("x-goog-generation", "1")
+		w.Write([]byte("hallo"))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	g := &GCS{Base: ts.URL, Headers: []string{"Content-Language"}}
+	o, err := g.Open(ctx, "bucket", "index.html", nil)
+	if err != nil {
+		t.Fatalf("g.Open: %v", err)
+	}
+	o.Body.Close()
+	want := map[string]string{
+		"content-type":                       "text/html",
+		"content-language":                   "de",
+		"x-goog-meta-header-x-frame-options": "DENY",
+	}
+	if !reflect.DeepEqual(o.Meta, want) {
+		t.Errorf("o.Meta = %v; want %v", o.Meta, want)
+	}
+}
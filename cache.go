@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// defaultLRUSize is the size of the default in-process cache, in bytes.
+const defaultLRUSize = 64 << 20
+
+// ErrCacheMiss is returned by Cache.Get when the key is not found.
+var ErrCacheMiss = errors.New("weasel: cache miss")
+
+// Cache stores serialized objects.
+type Cache interface {
+	// Get returns the value stored under key, or ErrCacheMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores value under key for at most ttl.
+	// Zero ttl means the value has no expiration time.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the key. It does not return an error
+	// in the case of cache miss.
+	Delete(ctx context.Context, key string) error
+}
+
+// defaultCache is used by a Storage with nil Cache.
+var defaultCache Cache = NewLRU(defaultLRUSize)
+
+func init() {
+	if appengine.IsStandard() {
+		defaultCache = Memcache{}
+	}
+}
+
+// Memcache is a Cache backed by App Engine memcache.
+// It works only with App Engine contexts.
+type Memcache struct{}
+
+// Get implements Cache.Get.
+func (Memcache) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// Set implements Cache.Set.
+func (Memcache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	item := &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: ttl,
+	}
+	return memcache.Set(ctx, item)
+}
+
+// Delete implements Cache.Delete.
+func (Memcache) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		err = nil
+	}
+	return err
+}
+
+// LRU is an in-process Cache which evicts least recently used items
+// when total size of the values exceeds its limit.
+// It is safe for concurrent use.
+type LRU struct {
+	size int // max total size of the values, in bytes
+
+	mu    sync.Mutex
+	used  int                      // current total size of the values
+	ll    *list.List               // front is most recently used
+	items map[string]*list.Element // values are *lruItem
+}
+
+type lruItem struct {
+	key    string
+	value  []byte
+	expiry time.Time // zero means no expiration
+}
+
+// NewLRU creates a new LRU cache limited to size bytes of stored values.
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get implements Cache.Get.
+func (c *LRU) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	it := e.Value.(*lruItem)
+	if !it.expiry.IsZero() && time.Now().After(it.expiry) {
+		c.remove(e)
+		return nil, ErrCacheMiss
+	}
+	c.ll.MoveToFront(e)
+	return it.value, nil
+}
+
+// Set implements Cache.Set.
+// Values larger than the cache size are silently discarded.
+func (c *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	if len(value) > c.size {
+		return nil
+	}
+	it := &lruItem{key: key, value: value}
+	if ttl > 0 {
+		it.expiry = time.Now().Add(ttl)
+	}
+	c.items[key] = c.ll.PushFront(it)
+	c.used += len(value)
+	for c.used > c.size {
+		c.remove(c.ll.Back())
+	}
+	return nil
+}
+
+// Delete implements Cache.Delete.
+func (c *LRU) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+// remove deletes e from c. It must be called with c.mu held.
+func (c *LRU) remove(e *list.Element) {
+	it := c.ll.Remove(e).(*lruItem)
+	delete(c.items, it.key)
+	c.used -= len(it.value)
+}
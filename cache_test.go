@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(10)
+	c.Set(ctx, "a", []byte("aaaa"), 0)
+	c.Set(ctx, "b", []byte("bbbb"), 0)
+	// a becomes most recently used
+	if v, err := c.Get(ctx, "a"); err != nil || string(v) != "aaaa" {
+		t.Errorf("c.Get(a) = %q, %v; want aaaa", v, err)
+	}
+	// evicts b
+	c.Set(ctx, "c", []byte("cccc"), 0)
+	if _, err := c.Get(ctx, "b"); err != ErrCacheMiss {
+		t.Errorf("c.Get(b): %v; want ErrCacheMiss", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := c.Get(ctx, k); err != nil {
+			t.Errorf("c.Get(%s): %v", k, err)
+		}
+	}
+
+	// too large
+	c.Set(ctx, "big", []byte("01234567890"), 0)
+	if _, err := c.Get(ctx, "big"); err != ErrCacheMiss {
+		t.Errorf("c.Get(big): %v; want ErrCacheMiss", err)
+	}
+
+	// expired
+	c.Set(ctx, "a", []byte("aaaa"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := c.Get(ctx, "a"); err != ErrCacheMiss {
+		t.Errorf("c.Get(a): %v; want ErrCacheMiss", err)
+	}
+
+	c.Delete(ctx, "c")
+	if _, err := c.Get(ctx, "c"); err != ErrCacheMiss {
+		t.Errorf("c.Get(c): %v; want ErrCacheMiss", err)
+	}
+	if c.used != 0 {
+		t.Errorf("c.used = %d; want 0", c.used)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	addr, cmds, stop := fakeRedis(t)
+	defer stop()
+	ctx := context.Background()
+	c := &Redis{Addr: addr, Password: "secret", DB: 2}
+	if _, err := c.Get(ctx, "key"); err != ErrCacheMiss {
+		t.Fatalf("c.Get(key): %v; want ErrCacheMiss", err)
+	}
+	if err := c.Set(ctx, "key", []byte("val\r\nue"), 2*time.Second); err != nil {
+		t.Fatalf("c.Set: %v", err)
+	}
+	v, err := c.Get(ctx, "key")
+	if err != nil || string(v) != "val\r\nue" {
+		t.Errorf("c.Get(key) = %q, %v; want 'val\\r\\nue'", v, err)
+	}
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Errorf("c.Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, "key"); err != ErrCacheMiss {
+		t.Errorf("c.Get(key): %v; want ErrCacheMiss", err)
+	}
+
+	want := []string{
+		"AUTH secret",
+		"SELECT 2",
+		"GET key",
+		"SET key val\r\nue PX 2000",
+		"GET key",
+		"DEL key",
+		"GET key",
+	}
+	got := cmds()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q; want %q", got, want)
+	}
+}
+
+// fakeRedis starts a minimal in-memory Redis server.
+// It returns server address, a func reporting all received commands
+// and a func to stop the server.
+func fakeRedis(t *testing.T) (string, func() []string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu   sync.Mutex
+		cmds []string
+		data = make(map[string]string)
+	)
+	serve := func(c net.Conn) {
+		defer c.Close()
+		cn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+		for {
+			v, err := cn.readReply()
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, a := range v.([]interface{}) {
+				args = append(args, string(a.([]byte)))
+			}
+			mu.Lock()
+			cmds = append(cmds, strings.Join(args, " "))
+			var reply string
+			switch args[0] {
+			case "GET":
+				if v, ok := data[args[1]]; ok {
+					reply = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+				} else {
+					reply = "$-1\r\n"
+				}
+			case "SET":
+				data[args[1]] = args[2]
+				reply = "+OK\r\n"
+			case "DEL":
+				delete(data, args[1])
+				reply = ":1\r\n"
+			default:
+				reply = "+OK\r\n"
+			}
+			mu.Unlock()
+			c.Write([]byte(reply))
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	list := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), cmds...)
+	}
+	return ln.Addr().String(), list, func() { ln.Close() }
+}
@@ -0,0 +1,316 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chunkBuf is an Object.Body of a large object, which is cached
+// in chunks of cacheChunkSize bytes as the body is read, keeping
+// at most one chunk in memory.
+// When r is read to io.EOF, a manifest is cached under the object key,
+// with Chunks and Size fields set, and an empty Body.
+// If fill is not nil, it is updated as the chunks are cached.
+//
+// If the total size is below cacheItemMax and no chunks have been cached yet,
+// the object is cached as a single item instead.
+type chunkBuf struct {
+	objectBuf
+}
+
+func (c *chunkBuf) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.done() {
+		return n, err
+	}
+	if n > 0 {
+		c.buf.Write(p[:n])
+		c.Size += int64(n)
+		if c.Size >= c.stor.maxCacheSize() {
+			c.abort()
+			return n, err
+		}
+		for c.buf.Len() >= cacheChunkSize {
+			c.flush(c.buf.Next(cacheChunkSize))
+		}
+	}
+	if err == io.EOF && !c.done() {
+		switch {
+		case c.Chunks == 0 && c.buf.Len() < cacheItemMax:
+			c.Size = 0
+			c.Body = c.buf.Bytes()
+		case c.buf.Len() > 0:
+			c.flush(c.buf.Bytes())
+		}
+		if !c.done() {
+			c.stor.setCache(c.ctx, c.key, &c.objectBuf, c.ttl)
+		}
+		c.abort()
+	}
+	return n, err
+}
+
+// flush caches chunk b and advances c.Chunks.
+// It aborts caching on cache errors.
+func (c *chunkBuf) flush(b []byte) {
+	if c.ChunkID == "" {
+		c.ChunkID = newChunkID()
+	}
+	// the cache may keep b as is, while buf reuses its memory
+	b = append([]byte(nil), b...)
+	key := chunkKey(c.key, c.ChunkID, c.Chunks)
+	if err := c.stor.cache().Set(c.ctx, key, b, c.stor.entryTTL(c.Meta, c.ttl)); err != nil {
+		c.stor.errorf(c.ctx, "cache.Set(%q): %v", key, err)
+		c.abort()
+		return
+	}
+	c.Chunks++
+	if c.fill != nil {
+		c.fill.progress(c.Chunks)
+	}
+}
+
+// abort stops caching and releases buffered data.
+func (c *chunkBuf) abort() {
+	c.stor = nil
+	c.buf = bytes.Buffer{}
+}
+
+// done reports whether caching has been completed or aborted.
+func (c *chunkBuf) done() bool {
+	return c.stor == nil
+}
+
+// chunkFill tracks a large object of known size being cached in chunks
+// in background, so that its readers can read the chunks as soon as
+// they are cached instead of fetching the object on their own.
+type chunkFill struct {
+	mu     sync.Mutex
+	chunks int           // number of chunks cached so far
+	over   chan struct{} // closed when caching completes or aborts
+}
+
+func newChunkFill() *chunkFill {
+	return &chunkFill{over: make(chan struct{})}
+}
+
+// progress records that n chunks have been cached.
+func (f *chunkFill) progress(n int) {
+	f.mu.Lock()
+	f.chunks = n
+	f.mu.Unlock()
+}
+
+// cached reports whether chunk i has been cached.
+func (f *chunkFill) cached(i int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return i < f.chunks
+}
+
+// fillChunks caches the body of large object o of known size in chunks
+// as it is read. The body must have been retrieved within fctx,
+// a context detached from the fetch context ctx, see backendContext.
+// It returns o with a body which reads the object while it is cached,
+// and completes caching in background when closed, along with a manifest
+// of the object within ctx for concurrent callers. Their chunkReaders
+// read the chunks cached so far and fetch the rest from the backend.
+func (s *Storage) fillChunks(ctx, fctx context.Context, key string, o *Object, ttl time.Duration) (*Object, *objectBuf) {
+	f := newChunkFill()
+	id := newChunkID()
+	c := &chunkBuf{objectBuf{
+		Meta:    o.Meta,
+		ChunkID: id,
+		r:       o.Body,
+		key:     key,
+		ttl:     ttl,
+		ctx:     fctx,
+		stor:    s,
+		fill:    f,
+	}}
+	o.Body = &fillBody{c}
+	return o, &objectBuf{
+		Meta:    o.Meta,
+		Expires: time.Now().Add(ttl),
+		Size:    o.Size,
+		Chunks:  int((o.Size + cacheChunkSize - 1) / cacheChunkSize),
+		ChunkID: id,
+		key:     key,
+		ctx:     ctx,
+		stor:    s,
+		fill:    f,
+	}
+}
+
+// fillBody is an Object.Body of the caller fetching a large object
+// cached by fillChunks. Closing it doesn't wait for the rest of the object
+// to be cached, which is done in background.
+type fillBody struct {
+	c *chunkBuf
+}
+
+func (b *fillBody) Read(p []byte) (int, error) {
+	return b.c.Read(p)
+}
+
+func (b *fillBody) Close() error {
+	c := b.c
+	go func() {
+		p := make([]byte, 32<<10)
+		for !c.done() {
+			if _, err := c.Read(p); err != nil {
+				break
+			}
+		}
+		c.r.(io.Closer).Close()
+		close(c.fill.over)
+	}()
+	return nil
+}
+
+// newChunkID returns a ChunkID of a new object version.
+func newChunkID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// chunkKey returns a cache key of chunk i of a large object
+// cached under the key.
+func chunkKey(key, id string, i int) string {
+	return fmt.Sprintf("%s#chunk-%s-%d", key, id, i)
+}
+
+// chunkReader is a seekable Object.Body of a large object
+// cached in chunks, as described by manifest b.
+// Chunks are retrieved from cache lazily, one at a time.
+// Missing chunks are fetched from the backend with a range request,
+// including those not cached yet while the object is being cached,
+// as indicated by b.fill.
+type chunkReader struct {
+	b            *objectBuf // manifest, as returned by getCache or fillChunks
+	bucket, name string     // object origin
+	off          int64      // current offset
+	idx          int        // index of cur chunk, or -1
+	cur          []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.off >= cr.b.Size {
+		return 0, io.EOF
+	}
+	i := int(cr.off / cacheChunkSize)
+	if i != cr.idx {
+		b, err := cr.load(i)
+		if err != nil {
+			return 0, err
+		}
+		cr.idx, cr.cur = i, b
+	}
+	n := copy(p, cr.cur[cr.off-int64(i)*cacheChunkSize:])
+	cr.off += int64(n)
+	return n, nil
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.off
+	case io.SeekEnd:
+		offset += cr.b.Size
+	default:
+		return 0, errors.New("chunkReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("chunkReader.Seek: negative position")
+	}
+	cr.off = offset
+	return offset, nil
+}
+
+func (cr *chunkReader) Close() error {
+	return nil
+}
+
+// load returns chunk i from cache, or from the backend if the chunk
+// has been evicted or is yet to be cached by b.fill.
+// If the chunk cannot be retrieved, the manifest is removed from cache
+// so that the object is fetched again on subsequent requests.
+func (cr *chunkReader) load(i int) ([]byte, error) {
+	b, s, ctx := cr.b, cr.b.stor, cr.b.ctx
+	start := int64(i) * cacheChunkSize
+	size := b.Size - start
+	if size > cacheChunkSize {
+		size = cacheChunkSize
+	}
+	key := chunkKey(b.key, b.ChunkID, i)
+	pending := b.fill != nil && !b.fill.cached(i)
+	if !pending {
+		data, err := s.cache().Get(ctx, key)
+		if err == nil && int64(len(data)) == size {
+			return data, nil
+		}
+	}
+
+	rng := fmt.Sprintf("bytes=%d-%d", start, start+size-1)
+	data, err := cr.fetch(rng)
+	if err == nil && int64(len(data)) != size {
+		err = fmt.Errorf("chunk %d: got %d bytes; want %d", i, len(data), size)
+	}
+	if err != nil {
+		s.PurgeCache(ctx, cr.bucket, cr.name)
+		return nil, fmt.Errorf("%s/%s: %v", cr.bucket, cr.name, err)
+	}
+	if pending {
+		// cached by b.fill, unless it aborts
+		return data, nil
+	}
+	ttl := time.Until(b.Expires)
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl = s.entryTTL(b.Meta, ttl); ttl > 0 {
+		if err := s.cache().Set(ctx, key, data, ttl); err != nil {
+			s.errorf(ctx, "cache.Set(%q): %v", key, err)
+		}
+	}
+	return data, nil
+}
+
+// fetch retrieves the rng range of the object from the backend,
+// making sure it is the same version as the cached manifest.
+func (cr *chunkReader) fetch(rng string) ([]byte, error) {
+	b := cr.b
+	o, err := b.stor.backend().Open(b.ctx, cr.bucket, cr.name, &OpenOptions{Range: rng})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	if o.Meta["content-range"] == "" {
+		return nil, fmt.Errorf("range %q not satisfied", rng)
+	}
+	if etag := b.Meta["etag"]; etag != "" && o.Meta["etag"] != etag {
+		return nil, fmt.Errorf("etag %s; want %s", o.Meta["etag"], etag)
+	}
+	return ioutil.ReadAll(o.Body)
+}
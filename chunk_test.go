@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChunkedCache(t *testing.T) {
+	data := make([]byte, 3*cacheChunkSize-100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var hits, ranges int32
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("range") != "" {
+			atomic.AddInt32(&ranges, 1)
+		}
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer gcs.Close()
+
+	ctx := context.Background()
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(8 << 20)}
+	readAll := func() []byte {
+		o, err := stor.Open(ctx, "bucket", "big.bin")
+		if err != nil {
+			t.Fatalf("stor.Open: %v", err)
+		}
+		defer o.Body.Close()
+		if o.Size != int64(len(data)) {
+			t.Errorf("o.Size = %d; want %d", o.Size, len(data))
+		}
+		b, err := ioutil.ReadAll(o.Body)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return b
+	}
+
+	if b := readAll(); !bytes.Equal(b, data) {
+		t.Fatalf("first read: body mismatch")
+	}
+	key := stor.objectKey(ctx, "bucket", "big.bin")
+	m, err := stor.getCache(ctx, key)
+	if err != nil {
+		t.Fatalf("stor.getCache: %v", err)
+	}
+	if m.Chunks != 3 || m.Size != int64(len(data)) || len(m.Body) != 0 {
+		t.Errorf("manifest: chunks = %d, size = %d, body = %d; want 3, %d, 0", m.Chunks, m.Size, len(m.Body), len(data))
+	}
+	if b := readAll(); !bytes.Equal(b, data) {
+		t.Errorf("cached read: body mismatch")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("backend hits = %d; want 1", n)
+	}
+
+	// ranges are served from individual chunks
+	o, err := stor.Open(ctx, "bucket", "big.bin")
+	if err != nil {
+		t.Fatalf("stor.Open: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/big.bin", nil)
+	r.Header.Set("range", "bytes=1048570-1048579")
+	w := httptest.NewRecorder()
+	if err := stor.ServeObject(w, r, o); err != nil {
+		t.Fatalf("stor.ServeObject: %v", err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusPartialContent)
+	}
+	if b := w.Body.Bytes(); !bytes.Equal(b, data[1048570:1048580]) {
+		t.Errorf("range body = %v; want %v", b, data[1048570:1048580])
+	}
+
+	// evicted chunks are fetched from the backend
+	stor.Cache.Delete(ctx, chunkKey(key, m.ChunkID, 1))
+	if b := readAll(); !bytes.Equal(b, data) {
+		t.Errorf("evicted read: body mismatch")
+	}
+	if n := atomic.LoadInt32(&ranges); n != 1 {
+		t.Errorf("backend range requests = %d; want 1", n)
+	}
+	if _, err := stor.Cache.Get(ctx, chunkKey(key, m.ChunkID, 1)); err != nil {
+		t.Errorf("evicted chunk is not cached again: %v", err)
+	}
+
+	// too large
+	stor.MaxCacheSize = 1 << 20
+	stor.PurgeCache(ctx, "bucket", "big.bin")
+	readAll()
+	if _, err := stor.getCache(ctx, key); err != ErrCacheMiss {
+		t.Errorf("stor.getCache: %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestChunkedFillBackground(t *testing.T) {
+	data := make([]byte, 3*cacheChunkSize)
+	release := make(chan struct{})
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/octet-stream")
+		w.Header().Set("content-length", strconv.Itoa(len(data)))
+		w.Write(data[:cacheChunkSize])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(data[cacheChunkSize:])
+	}))
+	defer gcs.Close()
+	defer close(release)
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(8 << 20)}
+
+	// a HEAD request of an uncached object doesn't wait for it to be cached
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o, err := stor.Open(ctx, "bucket", "big.bin")
+		if err != nil {
+			t.Errorf("stor.Open: %v", err)
+			return
+		}
+		w := httptest.NewRecorder()
+		stor.ServeObject(w, httptest.NewRequest("HEAD", "/big.bin", nil), o)
+		o.Body.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HEAD waits for the object to be cached")
+	}
+	// caching outlives the request
+	cancel()
+	release <- struct{}{}
+	key := stor.objectKey(context.Background(), "bucket", "big.bin")
+	for i := 0; ; i++ {
+		b, err := stor.getCache(context.Background(), key)
+		if err == nil && b.Chunks == 3 {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("big.bin is not cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
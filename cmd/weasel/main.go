@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command weasel runs the server package frontend as a standalone
+// HTTP server, e.g. on Cloud Run, GKE or a local machine.
+//
+// Usage:
+//
+//	weasel [-addr :8080] [-config weasel.json] [-bucket my-gcs-bucket]
+//	       [-lru 64 | -redis 10.0.0.3:6379]
+//
+// The config file contains a JSON encoded server.Config, for instance:
+//
+//	{
+//	  "Storage": {"Base": "https://storage.googleapis.com", "Index": "index.html"},
+//	  "Buckets": {"default": "my-gcs-bucket"},
+//	  "HookPath": "/-/flush-gcs-cache",
+//	  "HookToken": "channel-secret"
+//	}
+//
+// If the config Storage is omitted, weasel.DefaultStorage is used.
+// The -bucket flag overrides the "default" bucket of the config.
+//
+// Objects are cached in-process, unless -redis flag is provided.
+// Redis AUTH password is read from REDIS_PASSWORD environment variable.
+//
+// GCS requests are authorized with Google Application Default Credentials.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/google/weasel"
+	"github.com/google/weasel/server"
+)
+
+var (
+	addr   = flag.String("addr", defaultAddr(), "address to listen on")
+	config = flag.String("config", "", "path to a JSON encoded server.Config")
+	bucket = flag.String("bucket", "", "default GCS bucket to serve content from")
+	lru    = flag.Int("lru", 64, "in-process cache size, in megabytes")
+	redis  = flag.String("redis", "", "Redis server address to use as the cache instead of in-process cache")
+)
+
+func main() {
+	flag.Parse()
+	conf := &server.Config{}
+	if *config != "" {
+		b, err := ioutil.ReadFile(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(b, conf); err != nil {
+			log.Fatalf("%s: %v", *config, err)
+		}
+	}
+	if conf.Storage == nil {
+		conf.Storage = weasel.DefaultStorage
+	}
+	if *redis != "" {
+		conf.Storage.Cache = &weasel.Redis{
+			Addr:     *redis,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		}
+	} else {
+		conf.Storage.Cache = weasel.NewLRU(*lru << 20)
+	}
+	if *bucket != "" {
+		if conf.Buckets == nil {
+			conf.Buckets = make(map[string]string)
+		}
+		conf.Buckets["default"] = *bucket
+	}
+	if conf.Buckets["default"] == "" {
+		log.Fatal("no default bucket; use -bucket or -config")
+	}
+
+	mux := http.NewServeMux()
+	server.Init(mux, conf)
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// defaultAddr returns listen address based on $PORT environment variable,
+// as set by Cloud Run and App Engine, or ":8080" if it is empty.
+func defaultAddr() string {
+	if p := os.Getenv("PORT"); p != "" {
+		return ":" + p
+	}
+	return ":8080"
+}
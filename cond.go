@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkPreconditions evaluates conditional headers of request r
+// against an object with the meta headers, as per RFC 7232 section 6.
+// It returns http.StatusNotModified or http.StatusPreconditionFailed
+// if the request must not be served normally, and zero otherwise.
+func checkPreconditions(r *http.Request, meta map[string]string) int {
+	etag := meta["etag"]
+	modtime := parseHTTPTime(meta["last-modified"])
+
+	if im := r.Header.Get("if-match"); im != "" {
+		if !etagMatch(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := parseHTTPTime(r.Header.Get("if-unmodified-since")); !ius.IsZero() && !modtime.IsZero() {
+		if modtime.After(ius) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	get := r.Method == "GET" || r.Method == "HEAD"
+	if inm := r.Header.Get("if-none-match"); inm != "" {
+		if !etagMatch(inm, etag, true) {
+			return 0
+		}
+		if get {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+	if ims := parseHTTPTime(r.Header.Get("if-modified-since")); get && !ims.IsZero() && !modtime.IsZero() {
+		if !modtime.After(ims) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// ifRange reports whether the Range header of request r should be honored,
+// based on r's If-Range header and the object meta headers.
+func ifRange(r *http.Request, meta map[string]string) bool {
+	v := r.Header.Get("if-range")
+	if v == "" {
+		return true
+	}
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		return etagMatch(v, meta["etag"], false)
+	}
+	// a date must be an exact match
+	t := parseHTTPTime(v)
+	return !t.IsZero() && t.Equal(parseHTTPTime(meta["last-modified"]))
+}
+
+// etagMatch reports whether etag is listed in the comma-separated list
+// of entity tags, which may also be "*" to match any existing entity.
+// Weak comparison ignores W/ prefixes, while strong comparison
+// never matches weak tags.
+func etagMatch(list, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHTTPTime parses an HTTP date, returning zero time if v is invalid.
+func parseHTTPTime(v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// failReader fails the test if it is read from.
+type failReader struct {
+	t *testing.T
+}
+
+func (r failReader) Read(p []byte) (int, error) {
+	r.t.Errorf("unexpected body read")
+	return 0, errors.New("failReader")
+}
+
+func (failReader) Close() error {
+	return nil
+}
+
+func TestServeConditional(t *testing.T) {
+	const (
+		etag    = `"v1"`
+		lastMod = "Tue, 01 Oct 2019 10:00:00 GMT"
+		before  = "Mon, 30 Sep 2019 10:00:00 GMT"
+		after   = "Wed, 02 Oct 2019 10:00:00 GMT"
+	)
+	tests := []struct {
+		method string
+		header map[string]string
+		code   int
+	}{
+		{"GET", map[string]string{"if-none-match": etag}, http.StatusNotModified},
+		{"GET", map[string]string{"if-none-match": `"v0", W/"v1"`}, http.StatusNotModified},
+		{"HEAD", map[string]string{"if-none-match": "*"}, http.StatusNotModified},
+		{"GET", map[string]string{"if-modified-since": lastMod}, http.StatusNotModified},
+		{"GET", map[string]string{"if-modified-since": after}, http.StatusNotModified},
+		// If-None-Match takes precedence over If-Modified-Since
+		{"GET", map[string]string{"if-none-match": `"v0"`, "if-modified-since": after}, http.StatusOK},
+		{"GET", map[string]string{"if-match": `"v0"`}, http.StatusPreconditionFailed},
+		{"GET", map[string]string{"if-match": "*"}, http.StatusOK},
+		{"GET", map[string]string{"if-unmodified-since": before}, http.StatusPreconditionFailed},
+		{"GET", map[string]string{"if-unmodified-since": lastMod}, http.StatusOK},
+		// preflight is never conditional
+		{"OPTIONS", map[string]string{"if-none-match": etag}, http.StatusOK},
+	}
+	stor := &Storage{}
+	for i, test := range tests {
+		o := &Object{
+			Meta: map[string]string{
+				"content-type":  "text/plain",
+				"etag":          etag,
+				"last-modified": lastMod,
+			},
+			Body: failReader{t},
+			Size: -1,
+		}
+		if test.code == http.StatusOK {
+			o.Body = bytesBody{bytes.NewReader([]byte("body"))}
+		}
+		r := httptest.NewRequest(test.method, "/", nil)
+		for k, v := range test.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, o); err != nil {
+			t.Errorf("%d: ServeObject: %v", i, err)
+		}
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		if w.Code == http.StatusNotModified {
+			if v := w.Header().Get("etag"); v != etag {
+				t.Errorf("%d: etag = %q; want %q", i, v, etag)
+			}
+			if v := w.Header().Get("content-type"); v != "" {
+				t.Errorf("%d: content-type = %q; want none", i, v)
+			}
+		}
+	}
+}
+
+func TestServeIfRange(t *testing.T) {
+	const lastMod = "Tue, 01 Oct 2019 10:00:00 GMT"
+	tests := []struct {
+		ifRange string
+		code    int
+	}{
+		{`"v1"`, http.StatusPartialContent},
+		{`"v0"`, http.StatusOK},
+		{`W/"v1"`, http.StatusOK},
+		{lastMod, http.StatusPartialContent},
+		{"Wed, 02 Oct 2019 10:00:00 GMT", http.StatusOK},
+	}
+	stor := &Storage{}
+	for _, test := range tests {
+		o := &Object{
+			Meta: map[string]string{"etag": `"v1"`, "last-modified": lastMod},
+			Body: bytesBody{bytes.NewReader([]byte("0123456789"))},
+			Size: 10,
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("range", "bytes=0-1")
+		r.Header.Set("if-range", test.ifRange)
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, o); err != nil {
+			t.Fatalf("%s: %v", test.ifRange, err)
+		}
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.ifRange, w.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// minCompressSize is the smallest object compressed on the fly.
+	minCompressSize = 256
+	// siblingMissTTL is how long a missing precompressed object
+	// is remembered in cache.
+	siblingMissTTL = 5 * time.Minute
+	// brotliLevel is a compression level of on the fly brotli encoding.
+	brotliLevel = 5
+)
+
+// encodings are content codings supported by ServeObject in order of
+// preference, along with name suffixes of precompressed objects.
+var encodings = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// negotiateEncoding returns a representation of object o
+// with a content coding acceptable by request r.
+// If o's content type is compressible, it prefers precompressed sibling
+// objects, such as "app.js.br" for "app.js", then compresses o on the fly.
+// Objects stored with a content coding r doesn't accept are decoded.
+//
+// If the returned object is not o, its Body must be closed by the caller.
+func (s *Storage) negotiateEncoding(ctx context.Context, r *http.Request, o *Object) *Object {
+	accept := parseAcceptEncoding(r.Header.Get("accept-encoding"))
+	if ce := o.Meta["content-encoding"]; ce != "" {
+		if accept(ce) || ce != "gzip" {
+			return o
+		}
+		return s.decodeObject(ctx, o)
+	}
+	if s.DisableCompression || r.Header.Get("range") != "" || !compressible(o.Meta["content-type"]) {
+		// ranges are served from the identity representation,
+		// and incompressible content isn't looked up for precompressed
+		// variants, which would cost extra backend requests
+		return o
+	}
+
+	var enc string
+	for _, e := range encodings {
+		if !accept(e.name) {
+			continue
+		}
+		if enc == "" {
+			enc = e.name
+		}
+		if o.name == "" {
+			continue
+		}
+		so, err := s.openSibling(ctx, o.bucket, o.name+e.ext)
+		if err != nil {
+			continue
+		}
+		meta := copyMeta(o.Meta)
+		for _, k := range []string{"etag", "last-modified"} {
+			delete(meta, k)
+			if v := so.Meta[k]; v != "" {
+				meta[k] = v
+			}
+		}
+		meta["content-encoding"] = e.name
+		return &Object{Meta: meta, Body: so.Body, Size: so.Size}
+	}
+	if enc == "" || (o.Size >= 0 && o.Size < minCompressSize) {
+		return o
+	}
+	return s.encodeObject(ctx, o, enc)
+}
+
+// openSibling opens a precompressed object, remembering missing ones in cache
+// for siblingMissTTL.
+func (s *Storage) openSibling(ctx context.Context, bucket, name string) (*Object, error) {
+	key := s.objectKey(ctx, bucket, name) + "#missing"
+	if _, err := s.cache().Get(ctx, key); err == nil {
+		return nil, &FetchError{Msg: "not found", Code: http.StatusNotFound}
+	}
+	o, err := s.Open(ctx, bucket, name)
+	if ferr, ok := err.(*FetchError); ok && (ferr.Code == http.StatusNotFound || ferr.Code == http.StatusForbidden) {
+		if err := s.cache().Set(ctx, key, []byte{1}, siblingMissTTL); err != nil {
+			s.errorf(ctx, "cache.Set(%q): %v", key, err)
+		}
+	}
+	return o, err
+}
+
+// encodeObject returns o compressed with the enc content coding.
+// Compressed objects are cached under a distinct key and reused
+// for as long as o's etag stays the same.
+func (s *Storage) encodeObject(ctx context.Context, o *Object, enc string) *Object {
+	meta := copyMeta(o.Meta)
+	meta["content-encoding"] = enc
+	if etag := o.Meta["etag"]; etag != "" {
+		meta["etag"] = variantETag(etag, enc)
+	}
+
+	var key string
+	if o.name != "" && meta["etag"] != "" {
+		key = s.objectKey(ctx, o.bucket, o.name) + "#" + enc
+		if b, err := s.getCache(ctx, key); err == nil && b.Meta["etag"] == meta["etag"] {
+			return &Object{Meta: meta, Body: bytesBody{bytes.NewReader(b.Body)}, Size: int64(len(b.Body))}
+		}
+	}
+
+	var body io.ReadCloser = newEncodeReader(o.Body, enc)
+	if ttl := s.cacheTTL(o.Meta); key != "" && ttl > 0 && o.Size < cacheItemMax {
+		body = &objectBuf{
+			Meta: meta,
+			r:    body,
+			key:  key,
+			ttl:  ttl,
+			ctx:  ctx,
+			stor: s,
+		}
+	}
+	return &Object{Meta: meta, Body: body, Size: -1}
+}
+
+// decodeObject returns gzip-encoded object o decoded to its identity form.
+// It returns o unchanged if o's body is not a valid gzip stream.
+func (s *Storage) decodeObject(ctx context.Context, o *Object) *Object {
+	zr, err := gzip.NewReader(o.Body)
+	if err != nil {
+		s.errorf(ctx, "%s/%s: gzip.NewReader: %v", o.bucket, o.name, err)
+		return o
+	}
+	meta := copyMeta(o.Meta)
+	delete(meta, "content-encoding")
+	if etag := meta["etag"]; etag != "" {
+		meta["etag"] = variantETag(etag, "identity")
+	}
+	// origin is omitted so that ranges aren't forwarded to the backend
+	return &Object{Meta: meta, Body: zr, Size: -1}
+}
+
+// OpenDecoded is similar to Open except that objects stored with gzip
+// content coding are returned decoded. It is meant for objects whose content
+// is read in place rather than served, such as configuration objects.
+func (s *Storage) OpenDecoded(ctx context.Context, bucket, name string) (*Object, error) {
+	o, err := s.Open(ctx, bucket, name)
+	if err != nil || o.Meta["content-encoding"] != "gzip" {
+		return o, err
+	}
+	do := s.decodeObject(ctx, o)
+	if do == o {
+		// the body has been partially consumed
+		o.Body.Close()
+		return nil, fmt.Errorf("%s/%s: invalid gzip content", bucket, name)
+	}
+	do.Body = decodedBody{do.Body, o.Body}
+	do.bucket, do.name = bucket, name
+	return do, nil
+}
+
+// decodedBody is a Body of a decoded object, which closes
+// the encoded source body.
+type decodedBody struct {
+	io.Reader
+	src io.Closer
+}
+
+func (b decodedBody) Close() error {
+	return b.src.Close()
+}
+
+// copyMeta returns a copy of object meta headers m.
+func copyMeta(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// variantETag returns an entity tag of an etag representation
+// with a different content coding.
+func variantETag(etag, coding string) string {
+	if strings.HasSuffix(etag, `"`) {
+		return etag[:len(etag)-1] + "-" + coding + `"`
+	}
+	return etag + "-" + coding
+}
+
+// parseAcceptEncoding parses Accept-Encoding header value v
+// and returns a func reporting whether a content coding is acceptable.
+func parseAcceptEncoding(v string) func(coding string) bool {
+	q := make(map[string]float64)
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, qv := s, 1.0
+		if i := strings.IndexByte(s, ';'); i >= 0 {
+			name = strings.TrimSpace(s[:i])
+			p := strings.TrimSpace(s[i+1:])
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					qv = f
+				}
+			}
+		}
+		q[strings.ToLower(name)] = qv
+	}
+	return func(coding string) bool {
+		if v, ok := q[coding]; ok {
+			return v > 0
+		}
+		v, ok := q["*"]
+		return ok && v > 0
+	}
+}
+
+// compressible reports whether content of the ctype content type
+// is worth compressing.
+func compressible(ctype string) bool {
+	if i := strings.IndexByte(ctype, ';'); i >= 0 {
+		ctype = ctype[:i]
+	}
+	ctype = strings.ToLower(strings.TrimSpace(ctype))
+	if strings.HasPrefix(ctype, "text/") || strings.HasSuffix(ctype, "+json") || strings.HasSuffix(ctype, "+xml") {
+		return true
+	}
+	switch ctype {
+	case "application/javascript",
+		"application/x-javascript",
+		"application/json",
+		"application/xml",
+		"application/wasm",
+		"application/vnd.ms-fontobject",
+		"font/otf",
+		"font/ttf",
+		"image/svg+xml",
+		"image/x-icon",
+		"image/vnd.microsoft.icon":
+		return true
+	}
+	return false
+}
+
+// encodeReader compresses its source as it is read.
+// Closing encodeReader does not close the source.
+type encodeReader struct {
+	src io.Reader
+	zw  io.WriteCloser // compresses into buf
+	buf bytes.Buffer
+	err error // sticky src error
+	p   [32 << 10]byte
+}
+
+func newEncodeReader(src io.Reader, enc string) *encodeReader {
+	e := &encodeReader{src: src}
+	switch enc {
+	case "br":
+		e.zw = brotli.NewWriterLevel(&e.buf, brotliLevel)
+	default:
+		e.zw = gzip.NewWriter(&e.buf)
+	}
+	return e
+}
+
+func (e *encodeReader) Read(p []byte) (int, error) {
+	for e.buf.Len() == 0 && e.err == nil {
+		n, err := e.src.Read(e.p[:])
+		if n > 0 {
+			if _, werr := e.zw.Write(e.p[:n]); werr != nil {
+				err = werr
+			}
+		}
+		if err == io.EOF {
+			if cerr := e.zw.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+		e.err = err
+	}
+	if e.buf.Len() > 0 {
+		return e.buf.Read(p)
+	}
+	return 0, e.err
+}
+
+func (e *encodeReader) Close() error {
+	return nil
+}
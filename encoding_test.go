@@ -0,0 +1,273 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestServeEncoding(t *testing.T) {
+	js := strings.Repeat("var a = 1;\n", 100)
+	var stored bytes.Buffer
+	zw := gzip.NewWriter(&stored)
+	zw.Write([]byte("stored gzip"))
+	zw.Close()
+
+	var (
+		mu   sync.Mutex
+		hits = make(map[string]int)
+	)
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		h := w.Header()
+		switch r.URL.Path {
+		case "/bucket/app.js":
+			h.Set("content-type", "application/javascript")
+			h.Set("etag", `"js"`)
+			w.Write([]byte(js))
+		case "/bucket/app.js.br":
+			h.Set("content-type", "application/octet-stream")
+			h.Set("etag", `"js-br"`)
+			w.Write([]byte("precompressed"))
+		case "/bucket/image.png":
+			h.Set("content-type", "image/png")
+			w.Write([]byte(js))
+		case "/bucket/custom.js":
+			h.Set("content-type", "application/javascript")
+			h.Set("x-goog-meta-header-vary", "Origin")
+			h.Set("x-goog-meta-header-allow", "GET, POST")
+			h.Set("x-goog-meta-header-access-control-allow-origin", "*")
+			w.Write([]byte(js))
+		case "/bucket/stored.txt":
+			h.Set("content-type", "text/plain")
+			h.Set("content-encoding", "gzip")
+			h.Set("etag", `"stored"`)
+			w.Write(stored.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(1 << 20)}
+
+	serve := func(name, accept, rng string) *httptest.ResponseRecorder {
+		o, err := stor.Open(context.Background(), "bucket", name)
+		if err != nil {
+			t.Fatalf("stor.Open(%q): %v", name, err)
+		}
+		defer o.Body.Close()
+		r := httptest.NewRequest("GET", "/"+name, nil)
+		if accept != "" {
+			r.Header.Set("accept-encoding", accept)
+		}
+		if rng != "" {
+			r.Header.Set("range", rng)
+		}
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, o); err != nil {
+			t.Fatalf("stor.ServeObject(%q): %v", name, err)
+		}
+		if v := w.Header().Get("vary"); v != "Accept-Encoding" {
+			t.Errorf("%s: vary = %q; want Accept-Encoding", name, v)
+		}
+		return w
+	}
+	decode := func(enc string, r io.Reader) string {
+		switch enc {
+		case "br":
+			r = brotli.NewReader(r)
+		case "gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+			r = zr
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", enc, err)
+		}
+		return string(b)
+	}
+
+	// precompressed variant
+	w := serve("app.js", "gzip, br", "")
+	if v := w.Header().Get("content-encoding"); v != "br" {
+		t.Errorf("app.js br: content-encoding = %q; want br", v)
+	}
+	if v := w.Header().Get("content-type"); v != "application/javascript" {
+		t.Errorf("app.js br: content-type = %q; want application/javascript", v)
+	}
+	if v := w.Header().Get("etag"); v != `"js-br"` {
+		t.Errorf("app.js br: etag = %q; want \"js-br\"", v)
+	}
+	if v := w.Body.String(); v != "precompressed" {
+		t.Errorf("app.js br: body = %q; want precompressed", v)
+	}
+
+	// on the fly, twice to hit the cached variant
+	for i := 0; i < 2; i++ {
+		w = serve("app.js", "gzip;q=0.8, br;q=0", "")
+		if v := w.Header().Get("content-encoding"); v != "gzip" {
+			t.Fatalf("%d: app.js gzip: content-encoding = %q; want gzip", i, v)
+		}
+		if v := w.Header().Get("etag"); v != `"js-gzip"` {
+			t.Errorf("%d: app.js gzip: etag = %q; want \"js-gzip\"", i, v)
+		}
+		if v := decode("gzip", w.Body); v != js {
+			t.Errorf("%d: app.js gzip: body = %q; want %q", i, v, js)
+		}
+	}
+	if n := hits["/bucket/app.js.gz"]; n != 1 {
+		t.Errorf("app.js.gz hits = %d; want 1", n)
+	}
+
+	// identity
+	w = serve("app.js", "", "")
+	if v := w.Header().Get("content-encoding"); v != "" {
+		t.Errorf("app.js: content-encoding = %q; want none", v)
+	}
+	if v := w.Body.String(); v != js {
+		t.Errorf("app.js: body = %q; want %q", v, js)
+	}
+	w = serve("app.js", "br", "bytes=0-2")
+	if v := w.Header().Get("content-encoding"); v != "" || w.Body.String() != "var" {
+		t.Errorf("app.js range: content-encoding = %q, body = %q; want none, var", v, w.Body.String())
+	}
+
+	// incompressible content has no precompressed variants
+	w = serve("image.png", "gzip, br", "")
+	if v := w.Header().Get("content-encoding"); v != "" {
+		t.Errorf("image.png: content-encoding = %q; want none", v)
+	}
+	if n := hits["/bucket/image.png.br"] + hits["/bucket/image.png.gz"]; n != 0 {
+		t.Errorf("image.png sibling hits = %d; want 0", n)
+	}
+
+	// custom vary metadata doesn't replace the content coding one
+	w = serve("custom.js", "gzip", "")
+	if v := w.Header()["Vary"]; strings.Join(v, ", ") != "Accept-Encoding, Origin" {
+		t.Errorf("custom.js: vary = %q; want [Accept-Encoding Origin]", v)
+	}
+	if v := w.Header().Get("allow"); v != allowMethods {
+		t.Errorf("custom.js: allow = %q; want %q", v, allowMethods)
+	}
+	if v := w.Header().Get("access-control-allow-origin"); v != "" {
+		t.Errorf("custom.js: access-control-allow-origin = %q; want none", v)
+	}
+
+	// stored with gzip content coding
+	w = serve("stored.txt", "gzip", "")
+	if v := w.Header().Get("content-encoding"); v != "gzip" {
+		t.Errorf("stored.txt gzip: content-encoding = %q; want gzip", v)
+	}
+	if v := decode("gzip", w.Body); v != "stored gzip" {
+		t.Errorf("stored.txt gzip: body = %q; want 'stored gzip'", v)
+	}
+	w = serve("stored.txt", "", "")
+	if v := w.Header().Get("content-encoding"); v != "" {
+		t.Errorf("stored.txt: content-encoding = %q; want none", v)
+	}
+	if v := w.Header().Get("etag"); v != `"stored-identity"` {
+		t.Errorf("stored.txt: etag = %q; want \"stored-identity\"", v)
+	}
+	if v := w.Body.String(); v != "stored gzip" {
+		t.Errorf("stored.txt: body = %q; want 'stored gzip'", v)
+	}
+}
+
+func TestOpenDecoded(t *testing.T) {
+	var stored bytes.Buffer
+	zw := gzip.NewWriter(&stored)
+	zw.Write([]byte(`{"a": 1}`))
+	zw.Close()
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		switch r.URL.Path {
+		case "/bucket/stored.json":
+			h.Set("content-encoding", "gzip")
+			h.Set("etag", `"stored"`)
+			w.Write(stored.Bytes())
+		case "/bucket/plain.json":
+			w.Write([]byte(`{"b": 2}`))
+		case "/bucket/broken.json":
+			h.Set("content-encoding", "gzip")
+			w.Write([]byte("not gzip"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(1 << 20)}
+
+	ctx := context.Background()
+	for _, test := range []struct{ name, body string }{
+		{"stored.json", `{"a": 1}`},
+		{"stored.json", `{"a": 1}`}, // from cache
+		{"plain.json", `{"b": 2}`},
+	} {
+		o, err := stor.OpenDecoded(ctx, "bucket", test.name)
+		if err != nil {
+			t.Fatalf("OpenDecoded(%q): %v", test.name, err)
+		}
+		b, err := ioutil.ReadAll(o.Body)
+		o.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", test.name, err)
+		}
+		if string(b) != test.body {
+			t.Errorf("%s: body = %q; want %q", test.name, b, test.body)
+		}
+		if v := o.Meta["content-encoding"]; v != "" {
+			t.Errorf("%s: content-encoding = %q; want none", test.name, v)
+		}
+	}
+	if _, err := stor.OpenDecoded(ctx, "bucket", "broken.json"); err == nil {
+		t.Error("OpenDecoded(broken.json): no error")
+	}
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		v, coding string
+		ok        bool
+	}{
+		{"", "gzip", false},
+		{"gzip, deflate", "gzip", true},
+		{"gzip, deflate", "br", false},
+		{"br;q=0.5, gzip;q=0", "gzip", false},
+		{"BR", "br", true},
+		{"*", "br", true},
+		{"*;q=0, gzip", "br", false},
+	}
+	for _, test := range tests {
+		if ok := parseAcceptEncoding(test.v)(test.coding); ok != test.ok {
+			t.Errorf("parseAcceptEncoding(%q)(%q) = %v; want %v", test.v, test.coding, ok, test.ok)
+		}
+	}
+}
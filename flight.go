@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// flight is a backend fetch in progress.
+type flight struct {
+	done chan struct{} // closed when b and err are set
+	b    *objectBuf    // shared result, if any
+	err  error         // shared error, if any
+}
+
+// flights are backend fetches in progress, keyed by cache key.
+var flights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: make(map[string]*flight)}
+
+// coalesced is the number of coalesced Storage.Open calls.
+var coalesced int64
+
+// CoalescedRequests returns the number of Storage.Open calls
+// which received results of a concurrent backend fetch of the same object,
+// instead of fetching it on their own.
+func CoalescedRequests() int64 {
+	return atomic.LoadInt64(&coalesced)
+}
+
+// coalesce calls fetch unless a fetch of the same key is already in progress,
+// in which case it waits for and returns the shared result.
+// Objects are shared if the fetch reads them in full, or caches them
+// in chunks, and errors only if they are a FetchError. Otherwise, such as
+// for uncacheable objects or large ones of unknown size, waiters fall back
+// to calling fetch, which isn't counted in CoalescedRequests.
+//
+// Flights of objects cached in chunks last until the last chunk is cached,
+// so that callers arriving meanwhile read the chunks cached so far,
+// fetching the rest with range requests instead of the whole object.
+func (s *Storage) coalesce(ctx context.Context, key, bucket, name string, fetch func() (*Object, *objectBuf, error)) (*Object, error) {
+	flights.Lock()
+	if f, ok := flights.m[key]; ok {
+		flights.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		switch {
+		case f.err != nil:
+			atomic.AddInt64(&coalesced, 1)
+			return nil, f.err
+		case f.b != nil:
+			atomic.AddInt64(&coalesced, 1)
+			// chunks of large objects are loaded in the waiter context
+			b := &objectBuf{
+				Meta:    f.b.Meta,
+				Body:    f.b.Body,
+				Expires: f.b.Expires,
+				Size:    f.b.Size,
+				Chunks:  f.b.Chunks,
+				ChunkID: f.b.ChunkID,
+				key:     key,
+				ctx:     ctx,
+				stor:    s,
+				fill:    f.b.fill,
+			}
+			return b.object(bucket, name), nil
+		}
+		o, _, err := fetch()
+		return o, err
+	}
+	f := &flight{done: make(chan struct{})}
+	flights.m[key] = f
+	flights.Unlock()
+
+	o, b, err := fetch()
+	f.b = b
+	if _, ok := err.(*FetchError); ok {
+		f.err = err
+	}
+	if b != nil && b.fill != nil {
+		close(f.done)
+		go func() {
+			<-b.fill.over
+			flights.Lock()
+			delete(flights.m, key)
+			flights.Unlock()
+		}()
+		return o, err
+	}
+	flights.Lock()
+	delete(flights.m, key)
+	flights.Unlock()
+	close(f.done)
+	return o, err
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		if r.URL.Path == "/bucket/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		w.Write([]byte("shared"))
+	}))
+	defer gcs.Close()
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(1 << 20)}
+
+	for _, name := range []string{"obj", "missing"} {
+		atomic.StoreInt32(&hits, 0)
+		before := CoalescedRequests()
+		const n = 5
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			bodies   []string
+			notFound int
+		)
+		open := func() {
+			defer wg.Done()
+			o, err := stor.Open(context.Background(), "bucket", name)
+			mu.Lock()
+			defer mu.Unlock()
+			if ferr, ok := err.(*FetchError); ok && ferr.Code == http.StatusNotFound {
+				notFound++
+				return
+			}
+			if err != nil {
+				t.Errorf("%s: stor.Open: %v", name, err)
+				return
+			}
+			b, _ := ioutil.ReadAll(o.Body)
+			o.Body.Close()
+			bodies = append(bodies, string(b))
+		}
+		wg.Add(n)
+		go open()
+		for atomic.LoadInt32(&hits) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 1; i < n; i++ {
+			go open()
+		}
+		time.Sleep(50 * time.Millisecond) // let the waiters join the flight
+		close(release)
+		wg.Wait()
+		release = make(chan struct{})
+
+		if v := atomic.LoadInt32(&hits); v != 1 {
+			t.Errorf("%s: backend hits = %d; want 1", name, v)
+		}
+		if v := CoalescedRequests() - before; v != n-1 {
+			t.Errorf("%s: coalesced = %d; want %d", name, v, n-1)
+		}
+		if name == "missing" {
+			if notFound != n {
+				t.Errorf("%s: not found = %d; want %d", name, notFound, n)
+			}
+			continue
+		}
+		for _, b := range bodies {
+			if b != "shared" {
+				t.Errorf("%s: body = %q; want shared", name, b)
+			}
+		}
+	}
+}
+
+func TestCoalesceChunked(t *testing.T) {
+	data := make([]byte, 3*cacheChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var full, ranged int32
+	release := make(chan struct{})
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		} else {
+			atomic.AddInt32(&full, 1)
+		}
+		<-release
+		w.Header().Set("content-type", "video/mp4")
+		w.Header().Set("etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer gcs.Close()
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(8 << 20)}
+
+	before := CoalescedRequests()
+	const n = 5
+	var wg sync.WaitGroup
+	open := func() {
+		defer wg.Done()
+		o, err := stor.Open(context.Background(), "bucket", "video.mp4")
+		if err != nil {
+			t.Errorf("stor.Open: %v", err)
+			return
+		}
+		b, err := ioutil.ReadAll(o.Body)
+		o.Body.Close()
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("body mismatch: %d bytes, %v", len(b), err)
+		}
+	}
+	wg.Add(n)
+	go open()
+	for atomic.LoadInt32(&full) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < n; i++ {
+		go open()
+	}
+	time.Sleep(50 * time.Millisecond) // let the waiters join the flight
+	close(release)
+	wg.Wait()
+
+	// waiters fetch chunks which aren't cached yet with range requests
+	if f := atomic.LoadInt32(&full); f != 1 {
+		t.Errorf("backend full = %d; want 1", f)
+	}
+	if v := CoalescedRequests() - before; v != n-1 {
+		t.Errorf("coalesced = %d; want %d", v, n-1)
+	}
+
+	// the flight is over once the object is cached
+	b, err := stor.getCache(context.Background(), stor.objectKey(context.Background(), "bucket", "video.mp4"))
+	if err != nil || b.Chunks != 4 {
+		t.Fatalf("manifest: %v, %v; want 4 chunks", b, err)
+	}
+	for i := 0; ; i++ {
+		flights.Lock()
+		_, busy := flights.m[b.key]
+		flights.Unlock()
+		if !busy {
+			break
+		}
+		if i == 100 {
+			t.Fatal("flight is still in progress")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -3,7 +3,8 @@ module github.com/google/weasel
 go 1.13
 
 require (
-	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	github.com/andybalholm/brotli v1.0.2
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	google.golang.org/appengine v1.6.3
 )
@@ -15,26 +15,61 @@
 package weasel
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 )
 
 // allowMethods is a comman-separated list of allowed HTTP methods,
 // suitable for Allow or CORS allow-methods header.
 var allowMethods = "GET, HEAD, OPTIONS"
 
+// protectedHeaders cannot be set with custom object metadata,
+// along with CORS "access-control-" headers.
+var protectedHeaders = map[string]bool{
+	"allow":                     true,
+	"connection":                true,
+	"content-encoding":          true,
+	"content-length":            true,
+	"content-range":             true,
+	"location":                  true,
+	"set-cookie":                true,
+	"strict-transport-security": true,
+	"transfer-encoding":         true,
+}
+
 // ServeObject writes object o to w, with optional body and CORS headers,
 // based on the in-flight request r.
 func (s *Storage) ServeObject(w http.ResponseWriter, r *http.Request, o *Object) error {
+	// content coding
+	if r.Method != "OPTIONS" && o.Redirect() == "" {
+		w.Header().Add("vary", "Accept-Encoding")
+		if eo := s.negotiateEncoding(NewContext(r), r, o); eo != o {
+			defer eo.Body.Close()
+			o = eo
+		}
+	}
+
 	// headers
 	h := w.Header()
 	for k, v := range o.Meta {
+		if strings.HasPrefix(k, metaHeaderPrefix) {
+			k = k[len(metaHeaderPrefix):]
+			if _, ok := o.Meta[k]; ok || protectedHeaders[k] || strings.HasPrefix(k, "access-control-") {
+				continue
+			}
+		}
+		if k == "vary" {
+			// keep the vary of content coding
+			h.Add(k, v)
+			continue
+		}
 		h.Set(k, v)
 	}
 	h.Set("allow", allowMethods)
@@ -57,6 +92,32 @@ func (s *Storage) ServeObject(w http.ResponseWriter, r *http.Request, o *Object)
 		return nil
 	}
 
+	// conditional requests
+	if r.Method != "OPTIONS" {
+		switch code := checkPreconditions(r, o.Meta); code {
+		case http.StatusNotModified:
+			h.Del("content-type")
+			h.Del("content-length")
+			w.WriteHeader(code)
+			return nil
+		case http.StatusPreconditionFailed:
+			w.WriteHeader(code)
+			return nil
+		}
+	}
+
+	// preload related assets of full responses
+	if r.Method != "OPTIONS" && r.Header.Get("range") == "" {
+		s.addPreloadLinks(w, r, o)
+	}
+
+	h.Set("accept-ranges", "bytes")
+	if r.Method == "GET" && r.Header.Get("range") != "" && ifRange(r, o.Meta) {
+		if handled, err := s.serveRange(w, r, o); handled || err != nil {
+			return err
+		}
+	}
+
 	// body
 	if r.Method == "GET" {
 		_, err := io.Copy(w, o.Body)
@@ -66,6 +127,34 @@ func (s *Storage) ServeObject(w http.ResponseWriter, r *http.Request, o *Object)
 	return nil
 }
 
+// ServeError writes object o to w as the body of an error response
+// with the code status, such as a custom 404 page.
+// Like ServeObject, it serves o with a content coding acceptable by r.
+// The response is not cacheable.
+func (s *Storage) ServeError(w http.ResponseWriter, r *http.Request, o *Object, code int) error {
+	h := w.Header()
+	h.Add("vary", "Accept-Encoding")
+	if eo := s.negotiateEncoding(NewContext(r), r, o); eo != o {
+		defer eo.Body.Close()
+		o = eo
+	}
+	for _, k := range []string{"content-type", "content-encoding"} {
+		if v := o.Meta[k]; v != "" {
+			h.Set(k, v)
+		}
+	}
+	h.Set("cache-control", "no-cache")
+	if o.Size >= 0 {
+		h.Set("content-length", strconv.FormatInt(o.Size, 10))
+	}
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return nil
+	}
+	_, err := io.Copy(w, o.Body)
+	return err
+}
+
 // HandleChangeHook handles Object Change Notifications as described at
 // https://cloud.google.com/storage/docs/object-change-notification.
 // It removes objects from cache.
@@ -75,20 +164,29 @@ func (s *Storage) HandleChangeHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// this is not a client request, so don't use newContext.
-	ctx := appengine.NewContext(r)
+	ctx := NewContext(r)
 	// we only care about name and the bucket
 	body := struct{ Name, Bucket string }{}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Errorf(ctx, "json.Decode: %v", err.Error())
+		s.errorf(ctx, "json.Decode: %v", err.Error())
 		return
 	}
 	if err := s.PurgeCache(ctx, body.Bucket, body.Name); err != nil {
-		log.Errorf(ctx, "s.PurgeCache(%q, %q): %v", body.Bucket, body.Name, err)
+		s.errorf(ctx, "s.PurgeCache(%q, %q): %v", body.Bucket, body.Name, err)
 		w.WriteHeader(http.StatusInternalServerError) // let GCS retry
 	}
 }
 
+// NewContext returns a context for serving request r.
+// It is an App Engine context when running on App Engine standard,
+// and r.Context() otherwise.
+func NewContext(r *http.Request) context.Context {
+	if appengine.IsStandard() {
+		return appengine.NewContext(r)
+	}
+	return r.Context()
+}
+
 // ValidMethod reports whether m is a supported HTTP method.
 func ValidMethod(m string) bool {
 	return strings.Index(allowMethods, m) >= 0
@@ -15,14 +15,13 @@
 package weasel
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/memcache"
+	"time"
 )
 
 func TestServeRedirect(t *testing.T) {
@@ -49,6 +48,38 @@ func TestServeRedirect(t *testing.T) {
 	}
 }
 
+func TestServeCustomHeaders(t *testing.T) {
+	stor := &Storage{}
+	o := &Object{
+		Meta: map[string]string{
+			"content-type": "text/html",
+			metaHeaderPrefix + "content-security-policy": "default-src 'self'",
+			metaHeaderPrefix + "content-type":            "text/plain",
+			metaHeaderPrefix + "content-length":          "0",
+		},
+		Body: ioutil.NopCloser(strings.NewReader("hello")),
+		Size: 5,
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if err := stor.ServeObject(w, r, o); err != nil {
+		t.Fatal(err)
+	}
+	h := w.Header()
+	if v := h.Get("content-security-policy"); v != "default-src 'self'" {
+		t.Errorf("content-security-policy = %q; want default-src 'self'", v)
+	}
+	if v := h.Get("content-type"); v != "text/html" {
+		t.Errorf("content-type = %q; want text/html", v)
+	}
+	if v := h.Get("content-length"); v != "" {
+		t.Errorf("content-length = %q; want none", v)
+	}
+	if v := h.Get(metaHeaderPrefix + "content-security-policy"); v != "" {
+		t.Errorf("%s = %q; want none", metaHeaderPrefix+"content-security-policy", v)
+	}
+}
+
 func TestServeCross(t *testing.T) {
 	stor := &Storage{
 		CORS: CORS{
@@ -122,24 +153,22 @@ func TestServeCrossPreflight(t *testing.T) {
 }
 
 func TestHook(t *testing.T) {
-	var stor Storage
-	r, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(r)
-	cacheKey := stor.CacheKey("dummy", "path/obj")
-	item := &memcache.Item{Key: cacheKey, Value: []byte("ignored")}
-	if err := memcache.Set(ctx, item); err != nil {
+	stor := &Storage{Cache: NewLRU(1 << 20)}
+	ctx := context.Background()
+	cacheKey := stor.objectKey(ctx, "dummy", "path/obj")
+	if err := stor.Cache.Set(ctx, cacheKey, []byte("ignored"), time.Minute); err != nil {
 		t.Fatal(err)
 	}
 
 	body := `{"bucket": "dummy", "name": "path/obj"}`
-	req, _ := testInstance.NewRequest("POST", "/hook", strings.NewReader(body))
+	req, _ := http.NewRequest("POST", "/hook", strings.NewReader(body))
 	res := httptest.NewRecorder()
 	stor.HandleChangeHook(res, req)
 	if res.Code != http.StatusOK {
 		t.Errorf("res.Code = %d; want %d", res.Code, http.StatusOK)
 	}
 	// Must remove cached item.
-	if _, err := memcache.Get(ctx, cacheKey); err != memcache.ErrCacheMiss {
-		t.Fatalf("memcache.Get(%q): %v; want ErrCacheMiss", cacheKey, err)
+	if _, err := stor.Cache.Get(ctx, cacheKey); err != ErrCacheMiss {
+		t.Fatalf("stor.Cache.Get(%q): %v; want ErrCacheMiss", cacheKey, err)
 	}
 }
@@ -3,17 +3,27 @@ package internal
 
 import (
 	"context"
+
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
-// AETokenSource returns App Engine OAuth2 token source
-// given a context.Context and a slice of scopes.
+// TokenSource returns Google Application Default Credentials
+// token source given a context.Context and a slice of scopes.
 // It is a stubbed static token source during testing.
-var AETokenSource = func(ctx context.Context, scope ...string) oauth2.TokenSource {
-  ts, err := google.DefaultTokenSource(ctx, scope...)
-  if (err != nil) {
-    panic(err)
-  }
-  return ts
+var TokenSource = func(ctx context.Context, scope ...string) oauth2.TokenSource {
+	ts, err := google.DefaultTokenSource(ctx, scope...)
+	if err != nil {
+		return errTokenSource{err}
+	}
+	return ts
+}
+
+// errTokenSource is an oauth2.TokenSource which always fails with err.
+type errTokenSource struct {
+	err error
+}
+
+func (ts errTokenSource) Token() (*oauth2.Token, error) {
+	return nil, ts.err
 }
@@ -0,0 +1,171 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// listPageSize is the max number of entries in a single listing page.
+	listPageSize = 1000
+	// listCacheControl is cache-control of generated listings.
+	listCacheControl = "public, max-age=60"
+)
+
+// ListFormat is a format of directory listings generated by Storage.OpenList.
+type ListFormat int
+
+const (
+	ListHTML ListFormat = iota // an HTML page
+	ListJSON                   // a JSON object
+)
+
+// listing is a single page of a directory listing.
+type listing struct {
+	Prefix        string      `json:"prefix"`
+	Prefixes      []listEntry `json:"prefixes"`
+	Objects       []listEntry `json:"objects"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
+// listEntry is a listed object or a sub-prefix.
+type listEntry struct {
+	Name        string     `json:"name"` // relative to the listing prefix
+	Size        int64      `json:"size,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Updated     *time.Time `json:"updated,omitempty"` // nil for sub-prefixes
+}
+
+// URL returns a relative URL of the entry.
+func (e listEntry) URL() string {
+	u := &url.URL{Path: e.Name}
+	return u.String()
+}
+
+// listTemplate renders HTML listings.
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of /{{.Prefix}}</title></head>
+<body>
+<h1>Index of /{{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>
+{{if .Prefix}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Prefixes}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>-</td><td></td></tr>
+{{end}}{{range .Objects}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{with .Updated}}{{.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+{{end}}</table>
+{{with .NextPageToken}}<p><a href="?page={{.}}">Next page</a></p>
+{{end}}</body>
+</html>
+`))
+
+// OpenList returns a listing of objects and sub-prefixes of the bucket
+// under the prefix, which is normally a directory name ending with "/".
+// The listing is rendered in the given format and cached like any other
+// object for a short time.
+//
+// The pageToken is a token of the next page, which is included in a listing
+// if there are more entries than fit in a single page.
+// OpenList returns a FetchError with 404 code if there are no entries.
+func (s *Storage) OpenList(ctx context.Context, bucket, prefix, pageToken string, f ListFormat) (*Object, error) {
+	key := s.listKey(ctx, bucket, prefix, pageToken, f)
+	if b, err := s.getCache(ctx, key); err == nil && b.fresh() {
+		return b.object("", ""), nil
+	}
+
+	l, err := s.backend().List(ctx, bucket, &ListQuery{
+		Prefix:     prefix,
+		Delimiter:  "/",
+		PageToken:  pageToken,
+		MaxResults: listPageSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ls := &listing{
+		Prefix:        prefix,
+		Prefixes:      []listEntry{},
+		Objects:       []listEntry{},
+		NextPageToken: l.NextPageToken,
+	}
+	for _, p := range l.Prefixes {
+		ls.Prefixes = append(ls.Prefixes, listEntry{Name: strings.TrimPrefix(p, prefix)})
+	}
+	for _, o := range l.Objects {
+		if o.Name == prefix {
+			// directory placeholder
+			continue
+		}
+		e := listEntry{
+			Name:        strings.TrimPrefix(o.Name, prefix),
+			Size:        o.Size,
+			ContentType: o.ContentType,
+		}
+		if !o.Updated.IsZero() {
+			updated := o.Updated
+			e.Updated = &updated
+		}
+		ls.Objects = append(ls.Objects, e)
+	}
+	if len(ls.Prefixes) == 0 && len(ls.Objects) == 0 && pageToken == "" {
+		return nil, &FetchError{Msg: "empty listing", Code: http.StatusNotFound}
+	}
+
+	var buf bytes.Buffer
+	meta := map[string]string{"cache-control": listCacheControl}
+	switch f {
+	case ListJSON:
+		meta["content-type"] = "application/json"
+		err = json.NewEncoder(&buf).Encode(ls)
+	default:
+		meta["content-type"] = "text/html; charset=utf-8"
+		err = listTemplate.Execute(&buf, ls)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := fnv.New64a()
+	h.Write(buf.Bytes())
+	meta["etag"] = fmt.Sprintf(`"%x"`, h.Sum64())
+
+	b := &objectBuf{Meta: meta, Body: buf.Bytes()}
+	if ttl := s.cacheTTL(meta); ttl > 0 {
+		s.setCache(ctx, key, b, ttl)
+	}
+	return b.object("", ""), nil
+}
+
+// listKey returns a cache key of a listing page.
+func (s *Storage) listKey(ctx context.Context, bucket, prefix, pageToken string, f ListFormat) string {
+	return fmt.Sprintf("%s#list-%d-%s", s.objectKey(ctx, bucket, prefix), f, pageToken)
+}
+
+// listKeys returns cache keys of the first pages of a directory listing.
+func (s *Storage) listKeys(ctx context.Context, bucket, dir string) []string {
+	return []string{
+		s.listKey(ctx, bucket, dir, "", ListHTML),
+		s.listKey(ctx, bucket, dir, "", ListJSON),
+	}
+}
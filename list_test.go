@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenList(t *testing.T) {
+	ctx := context.Background()
+	stor := &Storage{
+		Base: "invalid",
+		Backend: memBackend{
+			"bucket/dl/":          "",
+			"bucket/dl/a b.zip":   "zip",
+			"bucket/dl/old/x.zip": "x",
+			"bucket/dl/readme":    "readme",
+		},
+		Cache: NewLRU(1 << 20),
+	}
+
+	o, err := stor.OpenList(ctx, "bucket", "dl/", "", ListJSON)
+	if err != nil {
+		t.Fatalf("stor.OpenList: %v", err)
+	}
+	b, _ := ioutil.ReadAll(o.Body)
+	var l listing
+	if err := json.Unmarshal(b, &l); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if strings.Contains(string(b), `"updated"`) {
+		t.Errorf("JSON listing contains unset updated time:\n%s", b)
+	}
+	if len(l.Prefixes) != 1 || l.Prefixes[0].Name != "old/" {
+		t.Errorf("l.Prefixes = %+v; want old/", l.Prefixes)
+	}
+	if len(l.Objects) != 2 || l.Objects[0].Name != "a b.zip" || l.Objects[0].Size != 3 || l.Objects[1].Name != "readme" {
+		t.Errorf("l.Objects = %+v; want 'a b.zip' of 3 bytes and readme", l.Objects)
+	}
+	if v := o.Meta["content-type"]; v != "application/json" {
+		t.Errorf("content-type = %q; want application/json", v)
+	}
+
+	o, err = stor.OpenList(ctx, "bucket", "dl/", "", ListHTML)
+	if err != nil {
+		t.Fatalf("stor.OpenList: %v", err)
+	}
+	b, _ = ioutil.ReadAll(o.Body)
+	for _, s := range []string{`href="../"`, `href="old/"`, `href="a%20b.zip"`, `>readme<`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("HTML listing doesn't contain %s:\n%s", s, b)
+		}
+	}
+	if strings.Contains(string(b), "0001-01-01") {
+		t.Errorf("HTML listing contains unset updated time:\n%s", b)
+	}
+
+	// cached
+	stor.Backend = memBackend{}
+	if _, err := stor.OpenList(ctx, "bucket", "dl/", "", ListHTML); err != nil {
+		t.Errorf("cached stor.OpenList: %v", err)
+	}
+	_, err = stor.OpenList(ctx, "bucket", "nope/", "", ListHTML)
+	if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusNotFound {
+		t.Errorf("stor.OpenList(nope/): %v; want 404", err)
+	}
+}
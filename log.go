@@ -0,0 +1,53 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	stdlog "log"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// Logger reports errors which cannot be returned to a caller.
+type Logger interface {
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+// DefaultLogger is used by a Storage with nil Logger.
+// It writes to App Engine logs when running on App Engine standard,
+// and to the standard log package otherwise.
+var DefaultLogger Logger = stdLogger{}
+
+func init() {
+	if appengine.IsStandard() {
+		DefaultLogger = aeLogger{}
+	}
+}
+
+// aeLogger writes to App Engine logs.
+type aeLogger struct{}
+
+func (aeLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	log.Errorf(ctx, format, args...)
+}
+
+// stdLogger writes to the standard logger of log package.
+type stdLogger struct{}
+
+func (stdLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	stdlog.Printf("ERROR: "+format, args...)
+}
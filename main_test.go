@@ -17,7 +17,6 @@ package weasel
 import (
 	"context"
 	"flag"
-	"log"
 	"os"
 	"strings"
 	"testing"
@@ -25,30 +24,18 @@ import (
 	"github.com/google/weasel/internal"
 
 	"golang.org/x/oauth2"
-	"google.golang.org/appengine/aetest"
 )
 
-// global App Engine test instance, initialized and shutdown in TestMain.
-var testInstance aetest.Instance
-
 func TestMain(m *testing.M) {
 	flag.Parse()
 
-	var err error
-	testInstance, err = aetest.NewInstance(nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// app engine token source stub
-	internal.AETokenSource = func(c context.Context, scopes ...string) oauth2.TokenSource {
+	// default credentials token source stub
+	internal.TokenSource = func(c context.Context, scopes ...string) oauth2.TokenSource {
 		t := &oauth2.Token{
 			AccessToken: "InvalidToken:" + strings.Join(scopes, ","),
 		}
 		return oauth2.StaticTokenSource(t)
 	}
 
-	code := m.Run()
-	testInstance.Close()
-	os.Exit(code)
+	os.Exit(m.Run())
 }
@@ -20,37 +20,53 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
-
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 const (
 	// object custom metadata
 	metaRedirect     = "x-goog-meta-redirect"
 	metaRedirectCode = "x-goog-meta-redirect-code"
+	metaPreload      = "x-goog-meta-preload" // comma-separated asset URLs
+	metaRewrite      = "x-goog-meta-rewrite" // name of an object to serve instead
+	metaHeaderPrefix = "x-goog-meta-header-" // prefix of custom response headers
+
+	// maxRewrites limits the number of followed rewrites
+	maxRewrites = 5
 
-	// memcache settings
-	cacheItemMax    = 1 << 20 // max size per item, in bytes
-	cacheItemExpiry = 24 * time.Hour
+	// cache settings
+	cacheItemMax    = 1 << 20        // max size per item, in bytes
+	defaultCacheTTL = 24 * time.Hour // used when Storage.MaxCacheTTL is zero
+	defaultStaleTTL = 24 * time.Hour // used when Storage.StaleTTL is zero
+
+	// chunked cache settings
+	cacheChunkSize      = 512 << 10 // cached chunk size of large objects, in bytes
+	defaultMaxCacheSize = 16 << 20  // used when Storage.MaxCacheSize is zero
 )
 
 // objectHeaders is a slice of headers propagated from a GCS object.
 var objectHeaders = []string{
 	"cache-control",
 	"content-disposition",
+	"content-encoding",
 	"content-type",
 	"etag",
 	"last-modified",
 	metaRedirect,
 	metaRedirectCode,
+	metaPreload,
+	metaRewrite,
 }
 
 // Object represents a single GCS object.
 type Object struct {
 	Meta map[string]string
 	Body io.ReadCloser
+	Size int64 // Body length in bytes, or -1 if unknown
+
+	// origin of the object, if retrieved with Storage
+	bucket, name string
 }
 
 // Redirect returns o's redirect URL, zero string otherwise.
@@ -58,6 +74,14 @@ func (o *Object) Redirect() string {
 	return o.Meta[metaRedirect]
 }
 
+// Rewrite returns a name of the object whose content is served in place of o,
+// zero string otherwise.
+// Names starting with "/" are relative to the bucket root, others to o's
+// directory.
+func (o *Object) Rewrite() string {
+	return o.Meta[metaRewrite]
+}
+
 // RedirectCode returns o's HTTP response code for redirect.
 // It defaults to http.StatusMovedPermanently.
 func (o *Object) RedirectCode() int {
@@ -68,17 +92,64 @@ func (o *Object) RedirectCode() int {
 	return c
 }
 
+// bytesBody is a seekable Object.Body of a cached object.
+type bytesBody struct {
+	*bytes.Reader
+}
+
+func (bytesBody) Close() error {
+	return nil
+}
+
+// parseCacheControl returns lowercase directive names of the cache-control
+// header value v, mapped to their unquoted arguments.
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		var arg string
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			d, arg = strings.TrimSpace(d[:i]), strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+		}
+		cc[strings.ToLower(d)] = arg
+	}
+	return cc
+}
+
+// parseSeconds returns v in seconds as time.Duration.
+// The ok result is false if v is not a valid non-negative number.
+func parseSeconds(v string) (d time.Duration, ok bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
 // objectBuf implements io.ReadCloser for Object.Body.
 // It stores all r.Read results in its buf and caches exported fields
-// in memcache when Read returns io.EOF.
+// in stor.Cache when Read returns io.EOF.
+//
+// A cached objectBuf with non-zero Chunks is a manifest of a large object,
+// whose body is cached in separate chunks. See chunkBuf for details.
 type objectBuf struct {
-	Meta map[string]string
-	Body []byte // set after rc returns io.EOF
+	Meta    map[string]string
+	Body    []byte    // set after rc returns io.EOF
+	Expires time.Time // cached object is stale after this time
+	Size    int64     // body size of a chunked object
+	Chunks  int       // number of body chunks
+	ChunkID string    // distinguishes chunks of different object versions
 
-	r   io.Reader
-	buf bytes.Buffer
-	key string          // cache key
-	ctx context.Context // memcache context
+	r    io.Reader
+	buf  bytes.Buffer
+	key  string          // cache key
+	ttl  time.Duration   // cache expiration
+	ctx  context.Context // cache context
+	stor *Storage        // storage to cache in
+	fill *chunkFill      // progress of caching a large object, if any
 }
 
 func (b *objectBuf) Read(p []byte) (int, error) {
@@ -88,18 +159,36 @@ func (b *objectBuf) Read(p []byte) (int, error) {
 	}
 	if err == io.EOF && b.buf.Len() < cacheItemMax {
 		b.Body = b.buf.Bytes()
-		item := memcache.Item{
-			Key:        b.key,
-			Object:     b,
-			Expiration: cacheItemExpiry,
-		}
-		if err := memcache.Gob.Set(b.ctx, &item); err != nil {
-			log.Errorf(b.ctx, "memcache.Gob.Set(%q): %v", b.key, err)
-		}
+		b.stor.setCache(b.ctx, b.key, b, b.ttl)
 	}
 	return n, err
 }
 
+// fresh reports whether b was cached no longer than its cache TTL ago.
+func (b *objectBuf) fresh() bool {
+	return b.Expires.IsZero() || time.Now().Before(b.Expires)
+}
+
+// object returns cached b as an Object of the bucket.
+func (b *objectBuf) object(bucket, name string) *Object {
+	if b.Chunks > 0 {
+		return &Object{
+			Meta:   b.Meta,
+			Body:   &chunkReader{b: b, bucket: bucket, name: name, idx: -1},
+			Size:   b.Size,
+			bucket: bucket,
+			name:   name,
+		}
+	}
+	return &Object{
+		Meta:   b.Meta,
+		Body:   bytesBody{bytes.NewReader(b.Body)},
+		Size:   int64(len(b.Body)),
+		bucket: bucket,
+		name:   name,
+	}
+}
+
 func (b *objectBuf) Close() error {
 	if c, ok := b.r.(io.Closer); ok {
 		return c.Close()
@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// pubsubPush is a Cloud Pub/Sub push request body.
+type pubsubPush struct {
+	Message struct {
+		Attributes map[string]string
+		Data       string // base64-encoded
+		MessageID  string `json:"messageId"`
+	}
+	Subscription string
+}
+
+// HandlePubSubPush handles Cloud Pub/Sub push messages carrying
+// Cloud Storage notifications, as described at
+// https://cloud.google.com/storage/docs/pubsub-notifications.
+// It removes changed objects from cache, along with their derived entries.
+func (s *Storage) HandlePubSubPush(w http.ResponseWriter, r *http.Request) {
+	ctx := NewContext(r)
+	var body pubsubPush
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		// acknowledge, as retrying won't help
+		s.errorf(ctx, "json.Decode: %v", err)
+		return
+	}
+	m := body.Message
+	bucket, name := m.Attributes["bucketId"], m.Attributes["objectId"]
+	if bucket == "" || name == "" {
+		// payload-only notifications carry the object resource in data
+		var obj struct{ Bucket, Name string }
+		if b, err := base64.StdEncoding.DecodeString(m.Data); err == nil {
+			json.Unmarshal(b, &obj)
+		}
+		bucket, name = obj.Bucket, obj.Name
+	}
+	if bucket == "" || name == "" {
+		s.errorf(ctx, "pubsub message %s: no object", m.MessageID)
+		return
+	}
+
+	switch ev := m.Attributes["eventType"]; ev {
+	case "OBJECT_FINALIZE", "OBJECT_DELETE", "OBJECT_ARCHIVE", "OBJECT_METADATA_UPDATE", "":
+		if err := s.PurgeCache(ctx, bucket, name); err != nil {
+			s.errorf(ctx, "s.PurgeCache(%q, %q) generation %s: %v", bucket, name, m.Attributes["objectGeneration"], err)
+			w.WriteHeader(http.StatusInternalServerError) // let Pub/Sub retry
+		}
+	default:
+		s.errorf(ctx, "pubsub message %s: unknown event type %q", m.MessageID, ev)
+	}
+}
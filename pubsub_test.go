@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlePubSubPush(t *testing.T) {
+	stor := &Storage{Cache: NewLRU(1 << 20)}
+	ctx := context.Background()
+	data := base64.StdEncoding.EncodeToString([]byte(`{"bucket": "b2", "name": "x.css"}`))
+	tests := []struct {
+		body   string
+		bucket string
+		name   string
+	}{
+		{
+			`{"message": {"attributes": {
+				"bucketId": "b1",
+				"objectId": "docs/app.js",
+				"eventType": "OBJECT_FINALIZE",
+				"objectGeneration": "1500000000000000"
+			}, "messageId": "1"}, "subscription": "projects/p/subscriptions/s"}`,
+			"b1", "docs/app.js",
+		},
+		{
+			`{"message": {"attributes": {"eventType": "OBJECT_DELETE"}, "data": "` + data + `"}}`,
+			"b2", "x.css",
+		},
+	}
+	for i, test := range tests {
+		keys := stor.cacheKeys(ctx, test.bucket, test.name)
+		for _, k := range keys {
+			stor.Cache.Set(ctx, k, []byte("ignored"), time.Minute)
+		}
+		r := httptest.NewRequest("POST", "/push", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		stor.HandlePubSubPush(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%d: w.Code = %d; want 200", i, w.Code)
+		}
+		for _, k := range keys {
+			if _, err := stor.Cache.Get(ctx, k); err != ErrCacheMiss {
+				t.Errorf("%d: stor.Cache.Get(%q): %v; want ErrCacheMiss", i, k, err)
+			}
+		}
+	}
+
+	// derived keys
+	want := []string{
+		stor.objectKey(ctx, "b1", "docs/app.js"),
+		stor.objectKey(ctx, "b1", "docs/app.js") + "#br",
+		stor.objectKey(ctx, "b1", "docs/app.js") + "#gzip",
+		stor.listKey(ctx, "b1", "docs/", "", ListHTML),
+		stor.listKey(ctx, "b1", "docs/", "", ListJSON),
+	}
+	keys := strings.Join(stor.cacheKeys(ctx, "b1", "docs/app.js"), " ")
+	for _, k := range want {
+		if !strings.Contains(keys, k) {
+			t.Errorf("cacheKeys = %s; want to contain %s", keys, k)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// genMemoTTL is how long generation numbers are reused in-process
+	// before they are looked up in cache again. It bounds the delay
+	// of purges made by other instances sharing the cache.
+	genMemoTTL = 10 * time.Second
+	// genMemoMax limits number of memoized generation numbers.
+	genMemoMax = 10000
+)
+
+// memoKey is a key of in-process memos, which are specific to a Storage
+// since its backend and cache may differ from other ones with the same
+// cache keys.
+type memoKey struct {
+	s   *Storage
+	key string
+}
+
+// generations memoizes directory generation numbers, keyed by genKey.
+var generations = struct {
+	sync.Mutex
+	m map[memoKey]*genEntry
+}{m: make(map[memoKey]*genEntry)}
+
+type genEntry struct {
+	gen     string
+	expires time.Time
+}
+
+// PurgePrefix invalidates all cached objects of the bucket with names
+// starting with prefix, along with entries derived from them.
+// The prefix is truncated after its last "/", so that "docs/v1" purges
+// everything under "docs/", while "docs" or an empty prefix purges
+// the whole bucket. Objects not matching prefix may thus be purged as well.
+//
+// It takes constant time regardless of the number of cached objects:
+// cache keys embed generation numbers of the bucket and of each directory
+// of the object, and PurgePrefix only starts a new generation of the prefix.
+// Other instances sharing the cache notice the purge within genMemoTTL.
+func (s *Storage) PurgePrefix(ctx context.Context, bucket, prefix string) error {
+	prefix = strings.TrimLeft(prefix, "/")
+	dir := prefix[:strings.LastIndexByte(prefix, '/')+1]
+	key, gen := s.genKey(bucket, dir), newGeneration()
+	if err := s.cache().Set(ctx, key, gen, 0); err != nil {
+		return err
+	}
+	s.memoGeneration(key, string(gen))
+	if s.PushManifest != "" && strings.HasPrefix(s.PushManifest, dir) {
+		s.forgetManifest(bucket)
+	}
+	if dir == "" {
+		return nil
+	}
+	// the parent listing may have the purged directory
+	for _, k := range s.listKeys(ctx, bucket, parentDir(strings.TrimSuffix(dir, "/"))) {
+		if err := s.cache().Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectKey returns a key to cache object name of the bucket under.
+// It is CacheKey suffixed with a hash of the bucket and object directories
+// generation numbers. Names ending with "/" include their own generation.
+func (s *Storage) objectKey(ctx context.Context, bucket, name string) string {
+	name = strings.TrimLeft(name, "/")
+	h := fnv.New64a()
+	for i := 0; ; {
+		fmt.Fprintf(h, "%s.", s.generation(ctx, bucket, name[:i]))
+		j := strings.IndexByte(name[i:], '/')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return fmt.Sprintf("%s@%x", s.CacheKey(bucket, name), h.Sum64())
+}
+
+// generation returns the current generation number of the bucket directory,
+// which is either empty for the bucket root or ends with "/".
+// Missing generations, such as evicted ones, are started anew,
+// which invalidates the directory cached objects.
+// Generations are memoized in-process for genMemoTTL, so that each object
+// key doesn't cost a cache round trip per directory level.
+func (s *Storage) generation(ctx context.Context, bucket, dir string) string {
+	key := s.genKey(bucket, dir)
+	generations.Lock()
+	e := generations.m[memoKey{s, key}]
+	generations.Unlock()
+	if e != nil && time.Now().Before(e.expires) {
+		return e.gen
+	}
+	v, err := s.cache().Get(ctx, key)
+	if err == nil {
+		s.memoGeneration(key, string(v))
+		return string(v)
+	}
+	gen := newGeneration()
+	if err != ErrCacheMiss {
+		// don't risk reusing a purged generation
+		s.errorf(ctx, "cache.Get(%q): %v", key, err)
+		return string(gen)
+	}
+	if err := s.cache().Set(ctx, key, gen, 0); err != nil {
+		s.errorf(ctx, "cache.Set(%q): %v", key, err)
+		return string(gen)
+	}
+	s.memoGeneration(key, string(gen))
+	return string(gen)
+}
+
+// memoGeneration memoizes generation number gen of the genKey key.
+func (s *Storage) memoGeneration(key, gen string) {
+	generations.Lock()
+	if len(generations.m) >= genMemoMax {
+		// arbitrary paths may be requested, so start over
+		// rather than grow without bounds
+		generations.m = make(map[memoKey]*genEntry)
+	}
+	generations.m[memoKey{s, key}] = &genEntry{gen: gen, expires: time.Now().Add(genMemoTTL)}
+	generations.Unlock()
+}
+
+// genKey returns a cache key of the bucket directory generation number.
+func (s *Storage) genKey(bucket, dir string) string {
+	return fmt.Sprintf("%s/%s#gen", s.CacheKey(bucket, ""), dir)
+}
+
+// genSeq disambiguates generations started at the same time.
+var genSeq uint32
+
+// newGeneration returns a generation number unlikely to be used before.
+func newGeneration() []byte {
+	n := atomic.AddUint32(&genSeq, 1)
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatUint(uint64(n), 36))
+}
+
+// parentDir returns the directory of object name, which is either empty
+// or ends with "/".
+func parentDir(name string) string {
+	dir := path.Dir(name) + "/"
+	if dir == "./" {
+		dir = ""
+	}
+	return dir
+}
+
+// purgeRequest is a HandlePurge request body.
+type purgeRequest struct {
+	Bucket   string
+	Names    []string // exact object names
+	Prefixes []string // name prefixes, "" for the whole bucket
+}
+
+// HandlePurge handles cache purge requests of a bucket.
+// The request is a POST with a JSON body, such as
+//
+//	{"bucket": "my-bucket", "names": ["index.html"], "prefixes": ["docs/"]}
+//
+// where names are purged with PurgeCache and prefixes with PurgePrefix.
+// An empty prefix purges the whole bucket.
+// The handler does no authentication.
+func (s *Storage) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := NewContext(r)
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" || len(req.Names)+len(req.Prefixes) == 0 {
+		http.Error(w, "bucket and names or prefixes are required", http.StatusBadRequest)
+		return
+	}
+	for _, p := range req.Prefixes {
+		if err := s.PurgePrefix(ctx, req.Bucket, p); err != nil {
+			s.errorf(ctx, "s.PurgePrefix(%q, %q): %v", req.Bucket, p, err)
+			http.Error(w, "purge failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, n := range req.Names {
+		if err := s.PurgeCache(ctx, req.Bucket, n); err != nil {
+			s.errorf(ctx, "s.PurgeCache(%q, %q): %v", req.Bucket, n, err)
+			http.Error(w, "purge failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPurgePrefix(t *testing.T) {
+	ctx := context.Background()
+	mem := memBackend{
+		"b/docs/a.txt":     "a1",
+		"b/docs/sub/b.txt": "b1",
+		"b/docs.txt":       "c1",
+		"b2/docs/a.txt":    "d1",
+	}
+	stor := &Storage{Base: "invalid", Backend: mem, Cache: NewLRU(1 << 20)}
+	read := func(bucket, name string) string {
+		o, err := stor.Open(ctx, bucket, name)
+		if err != nil {
+			t.Fatalf("stor.Open(%q, %q): %v", bucket, name, err)
+		}
+		defer o.Body.Close()
+		b, _ := ioutil.ReadAll(o.Body)
+		return string(b)
+	}
+	check := func(step string, want ...string) {
+		got := []string{read("b", "docs/a.txt"), read("b", "docs/sub/b.txt"), read("b", "docs.txt"), read("b2", "docs/a.txt")}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v; want %v", step, got, want)
+		}
+	}
+
+	check("initial", "a1", "b1", "c1", "d1")
+	for k, v := range mem {
+		mem[k] = v[:1] + "2"
+	}
+	check("cached", "a1", "b1", "c1", "d1")
+
+	if err := stor.PurgePrefix(ctx, "b", "docs/sub/"); err != nil {
+		t.Fatal(err)
+	}
+	check("docs/sub/", "a1", "b2", "c1", "d1")
+	if err := stor.PurgePrefix(ctx, "b", "docs/x"); err != nil {
+		t.Fatal(err)
+	}
+	check("docs/x", "a2", "b2", "c1", "d1")
+	for k, v := range mem {
+		mem[k] = v[:1] + "3"
+	}
+	if err := stor.PurgePrefix(ctx, "b", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	// all names starting with "docs", including docs.txt
+	check("docs", "a3", "b3", "c3", "d1")
+	for k, v := range mem {
+		mem[k] = v[:1] + "4"
+	}
+	if err := stor.PurgePrefix(ctx, "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("bucket", "a4", "b4", "c4", "d1")
+
+	// evicted generations invalidate cached objects
+	// once they are no longer memoized
+	mem["b2/docs/a.txt"] = "d5"
+	key := stor.genKey("b2", "docs/")
+	stor.Cache.Delete(ctx, key)
+	check("evicted memoized", "a4", "b4", "c4", "d1")
+	generations.Lock()
+	delete(generations.m, memoKey{stor, key})
+	generations.Unlock()
+	check("evicted", "a4", "b4", "c4", "d5")
+}
+
+// countCache counts Get calls of a Cache.
+type countCache struct {
+	Cache
+	gets int32
+}
+
+func (c *countCache) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.Cache.Get(ctx, key)
+}
+
+func TestGenerationMemo(t *testing.T) {
+	ctx := context.Background()
+	cache := &countCache{Cache: NewLRU(1 << 20)}
+	mem := memBackend{"memo/a/b/c/page.html": "page"}
+	stor := &Storage{Base: "invalid", Backend: mem, Cache: cache}
+	for i := 0; i < 2; i++ {
+		atomic.StoreInt32(&cache.gets, 0)
+		o, err := stor.Open(ctx, "memo", "a/b/c/page.html")
+		if err != nil {
+			t.Fatalf("%d: stor.Open: %v", i, err)
+		}
+		o.Body.Close()
+	}
+	if n := atomic.LoadInt32(&cache.gets); n != 1 {
+		t.Errorf("cache hit gets = %d; want 1", n)
+	}
+
+	// purges are seen right away by the purging instance
+	mem["memo/a/b/c/page.html"] = "new"
+	if err := stor.PurgePrefix(ctx, "memo", "a/b/"); err != nil {
+		t.Fatal(err)
+	}
+	o, err := stor.Open(ctx, "memo", "a/b/c/page.html")
+	if err != nil {
+		t.Fatalf("stor.Open: %v", err)
+	}
+	defer o.Body.Close()
+	if b, _ := ioutil.ReadAll(o.Body); string(b) != "new" {
+		t.Errorf("body = %q after purge; want new", b)
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	ctx := context.Background()
+	stor := &Storage{Base: "invalid", Backend: memBackend{}, Cache: NewLRU(1 << 20)}
+	key := stor.objectKey(ctx, "b", "index.html")
+	stor.Cache.Set(ctx, key, []byte("ignored"), 0)
+	dirKey := stor.objectKey(ctx, "b", "docs/a.txt")
+	stor.Cache.Set(ctx, dirKey, []byte("ignored"), 0)
+
+	tests := []struct {
+		method, body string
+		code         int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "{", http.StatusBadRequest},
+		{"POST", `{"bucket": "b"}`, http.StatusBadRequest},
+		{"POST", `{"bucket": "b", "names": ["index.html"], "prefixes": ["docs/"]}`, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/purge", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		stor.HandlePurge(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: w.Code = %d; want %d", test.method, test.body, w.Code, test.code)
+		}
+	}
+	if _, err := stor.Cache.Get(ctx, key); err != ErrCacheMiss {
+		t.Errorf("stor.Cache.Get(%q): %v; want ErrCacheMiss", key, err)
+	}
+	if k := stor.objectKey(ctx, "b", "docs/a.txt"); k == dirKey {
+		t.Errorf("objectKey of docs/a.txt = %q after purge; want a new key", k)
+	}
+}
+
+func TestPurgeCacheDerived(t *testing.T) {
+	ctx := context.Background()
+	mem := memBackend{
+		"derived/docs/index.html":    "docs",
+		"derived/push_manifest.json": `{"index.html": {"/v1.js": {"type": "script"}}}`,
+	}
+	stor := &Storage{
+		Base:         "invalid",
+		Index:        "index.html",
+		Backend:      mem,
+		Cache:        NewLRU(1 << 20),
+		PushManifest: "push_manifest.json",
+	}
+	redirect := func() string {
+		o, err := stor.OpenFile(ctx, "derived", "docs")
+		if err != nil {
+			return err.Error()
+		}
+		o.Body.Close()
+		return o.Redirect()
+	}
+
+	if v := redirect(); v != "/docs/" {
+		t.Fatalf("redirect() = %q; want /docs/", v)
+	}
+	delete(mem, "derived/docs/index.html")
+	if v := redirect(); v != "/docs/" {
+		t.Errorf("cached redirect() = %q; want /docs/", v)
+	}
+	if err := stor.PurgeCache(ctx, "derived", "docs/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	if v := redirect(); v == "/docs/" {
+		t.Errorf("redirect() = %q after purge; want an error", v)
+	}
+
+	mem["derived/docs/index.html"] = "docs"
+	if v := redirect(); v != "/docs/" {
+		t.Fatalf("redirect() = %q; want /docs/", v)
+	}
+	delete(mem, "derived/docs/index.html")
+	if err := stor.PurgePrefix(ctx, "derived", "docs/"); err != nil {
+		t.Fatal(err)
+	}
+	if v := redirect(); v == "/docs/" {
+		t.Errorf("redirect() = %q after prefix purge; want an error", v)
+	}
+
+	if pm := stor.pushManifest(ctx, "derived"); pm["index.html"]["/v1.js"].Type != "script" {
+		t.Fatalf("pushManifest = %v; want /v1.js", pm)
+	}
+	mem["derived/push_manifest.json"] = `{"index.html": {"/v2.js": {"type": "script"}}}`
+	if err := stor.PurgeCache(ctx, "derived", "push_manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+	if pm := stor.pushManifest(ctx, "derived"); pm["index.html"]["/v2.js"].Type != "script" {
+		t.Errorf("pushManifest = %v after purge; want /v2.js", pm)
+	}
+	mem["derived/push_manifest.json"] = `{"index.html": {"/v3.js": {"type": "script"}}}`
+	if err := stor.PurgePrefix(ctx, "derived", ""); err != nil {
+		t.Fatal(err)
+	}
+	if pm := stor.pushManifest(ctx, "derived"); pm["index.html"]["/v3.js"].Type != "script" {
+		t.Errorf("pushManifest = %v after prefix purge; want /v3.js", pm)
+	}
+
+	// memoized manifests aren't shared with other storages
+	other := &Storage{
+		Base:         "invalid",
+		Backend:      memBackend{"derived/push_manifest.json": `{"index.html": {"/other.js": {}}}`},
+		Cache:        NewLRU(1 << 20),
+		PushManifest: "push_manifest.json",
+	}
+	if pm := other.pushManifest(ctx, "derived"); len(pm["index.html"]) != 1 || pm["index.html"]["/other.js"] != (pushAsset{}) {
+		t.Errorf("other pushManifest = %v; want /other.js", pm)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// manifestTTL is how long a parsed push manifest is reused
+	// before it is looked up again.
+	manifestTTL = time.Minute
+	// maxPushCookie limits number of assets remembered in a push cookie.
+	maxPushCookie = 64
+)
+
+// pushAsset is an entry of a push manifest page.
+type pushAsset struct {
+	Type string `json:"type"` // preload "as" attribute, e.g. "style"
+}
+
+// pushManifest maps object names of pages to URLs of assets to preload.
+// The format is compatible with push_manifest.json of Polymer tools:
+//
+//	{
+//	  "index.html": {
+//	    "/css/app.css": {"type": "style"},
+//	    "/js/app.js": {"type": "script"}
+//	  }
+//	}
+type pushManifest map[string]map[string]pushAsset
+
+// manifests memoizes parsed push manifests, keyed by CacheKey.
+var manifests = struct {
+	sync.Mutex
+	m map[memoKey]*manifestEntry
+}{m: make(map[memoKey]*manifestEntry)}
+
+type manifestEntry struct {
+	pm      pushManifest
+	okey    string // objectKey of the manifest, which changes when purged
+	expires time.Time
+}
+
+// addPreloadLinks adds Link headers to w for assets related to object o,
+// which are listed in o's metaPreload and the bucket s.PushManifest.
+// Assets remembered by the push cookie of request r are skipped,
+// and the cookie is updated with the newly preloaded ones.
+func (s *Storage) addPreloadLinks(w http.ResponseWriter, r *http.Request, o *Object) {
+	assets := make(map[string]string) // url => type
+	for _, u := range strings.Split(o.Meta[metaPreload], ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			assets[u] = ""
+		}
+	}
+	if s.PushManifest != "" && o.name != "" {
+		pm := s.pushManifest(NewContext(r), o.bucket)
+		for u, a := range pm[strings.TrimPrefix(o.name, "/")] {
+			assets[u] = a.Type
+		}
+	}
+	if len(assets) == 0 {
+		return
+	}
+
+	h := w.Header()
+	var pushed []string
+	if s.PushCookie != "" {
+		// the links depend on the cookie, so shared caches must not
+		// serve responses to other visitors
+		h.Add("vary", "Cookie")
+		if c, err := r.Cookie(s.PushCookie); err == nil && c.Value != "" {
+			pushed = strings.Split(c.Value, ".")
+		}
+	}
+	seen := make(map[string]bool, len(pushed))
+	for _, hash := range pushed {
+		seen[hash] = true
+	}
+	urls := make([]string, 0, len(assets))
+	for u := range assets {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	var n int
+	for _, u := range urls {
+		hash := assetHash(u)
+		if seen[hash] {
+			continue
+		}
+		pushed = append(pushed, hash)
+		h.Add("link", preloadLink(u, assets[u]))
+		n++
+	}
+	if s.PushCookie == "" || n == 0 {
+		return
+	}
+	if n := len(pushed); n > maxPushCookie {
+		pushed = pushed[n-maxPushCookie:]
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.PushCookie,
+		Value:    strings.Join(pushed, "."),
+		Path:     "/",
+		HttpOnly: true,
+	})
+}
+
+// forgetManifest drops the memoized push manifest of the bucket.
+func (s *Storage) forgetManifest(bucket string) {
+	manifests.Lock()
+	delete(manifests.m, memoKey{s, s.CacheKey(bucket, s.PushManifest)})
+	manifests.Unlock()
+}
+
+// pushManifest returns the push manifest of the bucket.
+// It returns nil if the manifest cannot be retrieved.
+func (s *Storage) pushManifest(ctx context.Context, bucket string) pushManifest {
+	key := memoKey{s, s.CacheKey(bucket, s.PushManifest)}
+	okey := s.objectKey(ctx, bucket, s.PushManifest)
+	manifests.Lock()
+	e := manifests.m[key]
+	manifests.Unlock()
+	if e != nil && e.okey == okey && time.Now().Before(e.expires) {
+		return e.pm
+	}
+
+	var pm pushManifest
+	o, err := s.OpenDecoded(ctx, bucket, s.PushManifest)
+	if err == nil {
+		err = json.NewDecoder(o.Body).Decode(&pm)
+		o.Body.Close()
+	}
+	if ferr, ok := err.(*FetchError); err != nil && (!ok || ferr.Code != http.StatusNotFound) {
+		s.errorf(ctx, "push manifest %s/%s: %v", bucket, s.PushManifest, err)
+	}
+	manifests.Lock()
+	manifests.m[key] = &manifestEntry{pm: pm, okey: okey, expires: time.Now().Add(manifestTTL)}
+	manifests.Unlock()
+	return pm
+}
+
+// preloadLink formats a Link header value for asset u of the preload type.
+// If typ is empty, it is derived from u's file extension.
+func preloadLink(u, typ string) string {
+	if typ == "" {
+		typ = preloadType(u)
+	}
+	l := fmt.Sprintf("<%s>; rel=preload", u)
+	if typ != "" {
+		l += "; as=" + typ
+	}
+	if typ == "font" || typ == "fetch" {
+		// these are always fetched in CORS mode
+		l += "; crossorigin"
+	}
+	return l
+}
+
+// preloadType returns preload "as" attribute based on u's file extension.
+func preloadType(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	switch strings.ToLower(path.Ext(u)) {
+	case ".css":
+		return "style"
+	case ".js", ".mjs":
+		return "script"
+	case ".woff", ".woff2", ".ttf", ".otf", ".eot":
+		return "font"
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".svg", ".ico":
+		return "image"
+	case ".json":
+		return "fetch"
+	}
+	return ""
+}
+
+// assetHash returns a short hash of asset u, used in push cookies.
+func assetHash(u string) string {
+	h := fnv.New32a()
+	h.Write([]byte(u))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
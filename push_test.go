@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServePreload(t *testing.T) {
+	stor := &Storage{
+		Base: "invalid",
+		Backend: memBackend{
+			"bucket/push_manifest.json": `{
+				"index.html": {
+					"/app.js": {"type": "script"},
+					"/data": {"type": "fetch"}
+				}
+			}`,
+		},
+		Cache:        NewLRU(1 << 20),
+		PushManifest: "push_manifest.json",
+		PushCookie:   "push",
+	}
+	newObject := func() *Object {
+		return &Object{
+			Meta: map[string]string{
+				"content-type": "text/html",
+				metaPreload:    "/app.css, /font.woff2",
+			},
+			Body:   ioutil.NopCloser(strings.NewReader("hello")),
+			Size:   5,
+			bucket: "bucket",
+			name:   "index.html",
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := stor.ServeObject(w, r, newObject()); err != nil {
+		t.Fatalf("stor.ServeObject: %v", err)
+	}
+	want := []string{
+		"</app.css>; rel=preload; as=style",
+		"</app.js>; rel=preload; as=script",
+		"</data>; rel=preload; as=fetch; crossorigin",
+		"</font.woff2>; rel=preload; as=font; crossorigin",
+	}
+	if v := w.Header()["Link"]; !reflect.DeepEqual(v, want) {
+		t.Errorf("link = %q; want %q", v, want)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "push" {
+		t.Fatalf("cookies = %v; want a single push cookie", cookies)
+	}
+	if v := w.Header()["Vary"]; !reflect.DeepEqual(v, []string{"Accept-Encoding", "Cookie"}) {
+		t.Errorf("vary = %q; want Accept-Encoding and Cookie", v)
+	}
+
+	// repeat visit
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	if err := stor.ServeObject(w, r, newObject()); err != nil {
+		t.Fatalf("stor.ServeObject: %v", err)
+	}
+	if v := w.Header()["Link"]; len(v) != 0 {
+		t.Errorf("link = %q; want none", v)
+	}
+	if v := w.Header().Get("set-cookie"); v != "" {
+		t.Errorf("set-cookie = %q; want none", v)
+	}
+	if v := w.Header()["Vary"]; !reflect.DeepEqual(v, []string{"Accept-Encoding", "Cookie"}) {
+		t.Errorf("repeat vary = %q; want Accept-Encoding and Cookie", v)
+	}
+
+	// no cookie by default
+	stor.PushCookie = ""
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	if err := stor.ServeObject(w, r, newObject()); err != nil {
+		t.Fatalf("stor.ServeObject: %v", err)
+	}
+	if v := w.Header()["Link"]; len(v) != len(want) {
+		t.Errorf("no cookie link = %q; want %q", v, want)
+	}
+	if v := w.Header().Get("set-cookie"); v != "" {
+		t.Errorf("no cookie set-cookie = %q; want none", v)
+	}
+	if v := w.Header()["Vary"]; !reflect.DeepEqual(v, []string{"Accept-Encoding"}) {
+		t.Errorf("no cookie vary = %q; want Accept-Encoding", v)
+	}
+
+	// range requests are not full pages
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("range", "bytes=0-1")
+	if err := stor.ServeObject(w, r, newObject()); err != nil {
+		t.Fatalf("stor.ServeObject: %v", err)
+	}
+	if v := w.Header()["Link"]; len(v) != 0 {
+		t.Errorf("range link = %q; want none", v)
+	}
+}
+
+func TestPreloadType(t *testing.T) {
+	tests := []struct{ u, typ string }{
+		{"/a.css", "style"},
+		{"/a.js?v=1", "script"},
+		{"https://fonts.example.com/a.WOFF2", "font"},
+		{"/img/logo.svg#x", "image"},
+		{"/dir/", ""},
+	}
+	for _, test := range tests {
+		if v := preloadType(test.u); v != test.typ {
+			t.Errorf("preloadType(%q) = %q; want %q", test.u, v, test.typ)
+		}
+	}
+}
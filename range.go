@@ -0,0 +1,248 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("invalid range: failed to overlap")
+)
+
+// httpRange is a single byte range of an object.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header value as per RFC 7233.
+// It returns errNoOverlap if none of the ranges overlap an object of the size.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.IndexByte(ra, '-')
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// suffix range, the last N bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// serveRange responds to a GET request r carrying Range header.
+// It serves ranges from memory for cached and cacheable objects,
+// including chunks of large objects, and from the body of large objects
+// being cached if the range starts at the beginning of the object.
+// Other single ranges are forwarded to the backend.
+//
+// The returned handled is false if o.Body should be sent in full instead.
+func (s *Storage) serveRange(w http.ResponseWriter, r *http.Request, o *Object) (handled bool, err error) {
+	rng := r.Header.Get("range")
+	if b, ok := o.Body.(*objectBuf); ok && o.Size >= 0 {
+		// small enough to be cached; read it all and serve from memory
+		body, err := ioutil.ReadAll(b)
+		if err != nil {
+			return true, err
+		}
+		o.Body = bytesBody{bytes.NewReader(body)}
+		o.Size = int64(len(body))
+	}
+	if rs, ok := o.Body.(io.ReadSeeker); ok && o.Size >= 0 {
+		return serveSeekerRange(w, rng, o.Meta["content-type"], rs, o.Size)
+	}
+	if fb, ok := o.Body.(*fillBody); ok && o.Size >= 0 {
+		if handled, err := serveFillRange(w, rng, fb, o.Size); handled {
+			return true, err
+		}
+	}
+	if o.name == "" || strings.Contains(rng, ",") {
+		return false, nil
+	}
+
+	ctx := NewContext(r)
+	ro, err := s.backend().Open(ctx, o.bucket, o.name, &OpenOptions{Range: rng})
+	if ferr, ok := err.(*FetchError); ok && ferr.Code == http.StatusRequestedRangeNotSatisfiable {
+		if o.Size >= 0 {
+			w.Header().Set("content-range", fmt.Sprintf("bytes */%d", o.Size))
+		}
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+	if err != nil {
+		// the original body is still good to go
+		s.errorf(ctx, "%s/%s: range %q: %v", o.bucket, o.name, rng, err)
+		return false, nil
+	}
+	defer ro.Body.Close()
+	cr := ro.Meta["content-range"]
+	if cr == "" {
+		// the backend ignored range; use the original body
+		return false, nil
+	}
+	if etag := o.Meta["etag"]; etag != "" && ro.Meta["etag"] != etag {
+		// the object has changed since o was retrieved
+		s.errorf(ctx, "%s/%s: range %q: etag %s; want %s", o.bucket, o.name, rng, ro.Meta["etag"], etag)
+		return false, nil
+	}
+	h := w.Header()
+	h.Set("content-range", cr)
+	if ro.Size >= 0 {
+		h.Set("content-length", strconv.FormatInt(ro.Size, 10))
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.Copy(w, ro.Body)
+	return true, err
+}
+
+// serveFillRange writes a single byte range rng of a large object body fb
+// of the given size to w, if the range starts at the beginning of the object.
+// The rest of the object is cached in background once fb is closed.
+// Other ranges are not handled, since they are cheaper to fetch on their own
+// than to wait for.
+func serveFillRange(w http.ResponseWriter, rng string, fb *fillBody, size int64) (handled bool, err error) {
+	ranges, err := parseRange(rng, size)
+	if err != nil || len(ranges) != 1 || ranges[0].start != 0 {
+		return false, nil
+	}
+	ra := ranges[0]
+	h := w.Header()
+	h.Set("content-range", ra.contentRange(size))
+	h.Set("content-length", strconv.FormatInt(ra.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.CopyN(w, fb, ra.length)
+	return true, err
+}
+
+// serveSeekerRange writes byte ranges rng of rs of the given size to w,
+// as either a single part or multipart/byteranges response.
+func serveSeekerRange(w http.ResponseWriter, rng, ctype string, rs io.ReadSeeker, size int64) (handled bool, err error) {
+	ranges, err := parseRange(rng, size)
+	if err == errNoOverlap {
+		w.Header().Set("content-range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+	if err != nil || len(ranges) == 0 {
+		return false, nil
+	}
+	var total int64
+	for _, ra := range ranges {
+		total += ra.length
+	}
+	if total > size {
+		// overlapping ranges, which isn't worth serving in parts
+		return false, nil
+	}
+
+	h := w.Header()
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		if _, err := rs.Seek(ra.start, io.SeekStart); err != nil {
+			return true, err
+		}
+		h.Set("content-range", ra.contentRange(size))
+		h.Set("content-length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := io.CopyN(w, rs, ra.length)
+		return true, err
+	}
+
+	mw := multipart.NewWriter(w)
+	h.Set("content-type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	for _, ra := range ranges {
+		ph := textproto.MIMEHeader{"Content-Range": {ra.contentRange(size)}}
+		if ctype != "" {
+			ph.Set("Content-Type", ctype)
+		}
+		part, err := mw.CreatePart(ph)
+		if err != nil {
+			return true, err
+		}
+		if _, err := rs.Seek(ra.start, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := io.CopyN(part, rs, ra.length); err != nil {
+			return true, err
+		}
+	}
+	return true, mw.Close()
+}
@@ -0,0 +1,298 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		ranges []httpRange
+		err    error
+	}{
+		{"bytes=0-4", []httpRange{{0, 5}}, nil},
+		{"bytes=2-", []httpRange{{2, 8}}, nil},
+		{"bytes=-3", []httpRange{{7, 3}}, nil},
+		{"bytes=-20", []httpRange{{0, 10}}, nil},
+		{"bytes=5-100", []httpRange{{5, 5}}, nil},
+		{"bytes=0-0, 2-3,", []httpRange{{0, 1}, {2, 2}}, nil},
+		{"bytes=10-", nil, errNoOverlap},
+		{"bytes=10-20, 3-", []httpRange{{3, 7}}, nil},
+		{"bytes=-0", nil, errNoOverlap},
+		{"bytes=5-2", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=1", nil, errInvalidRange},
+		{"items=0-1", nil, errInvalidRange},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.s, 10)
+		if err != test.err {
+			t.Errorf("parseRange(%q) err = %v; want %v", test.s, err, test.err)
+		}
+		if !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseRange(%q) = %v; want %v", test.s, ranges, test.ranges)
+		}
+	}
+}
+
+func TestServeRangeCached(t *testing.T) {
+	const body = "0123456789"
+	stor := &Storage{}
+	newObject := func() *Object {
+		return &Object{
+			Meta: map[string]string{"content-type": "text/plain"},
+			Body: bytesBody{bytes.NewReader([]byte(body))},
+			Size: int64(len(body)),
+		}
+	}
+
+	tests := []struct {
+		rng, body, contentRange string
+		code                    int
+	}{
+		{"bytes=2-4", "234", "bytes 2-4/10", http.StatusPartialContent},
+		{"bytes=-2", "89", "bytes 8-9/10", http.StatusPartialContent},
+		{"bytes=20-", "", "bytes */10", http.StatusRequestedRangeNotSatisfiable},
+		{"bytes=invalid", body, "", http.StatusOK},
+		{"bytes=0-9,0-9", body, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("range", test.rng)
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, newObject()); err != nil {
+			t.Fatalf("%s: %v", test.rng, err)
+		}
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.rng, w.Code, test.code)
+		}
+		if v := w.Body.String(); v != test.body {
+			t.Errorf("%s: w.Body = %q; want %q", test.rng, v, test.body)
+		}
+		if v := w.Header().Get("content-range"); v != test.contentRange {
+			t.Errorf("%s: content-range = %q; want %q", test.rng, v, test.contentRange)
+		}
+		if v := w.Header().Get("accept-ranges"); v != "bytes" {
+			t.Errorf("%s: accept-ranges = %q; want bytes", test.rng, v)
+		}
+	}
+
+	// multipart
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("range", "bytes=0-1,5-6")
+	w := httptest.NewRecorder()
+	if err := stor.ServeObject(w, r, newObject()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusPartialContent)
+	}
+	mt, params, _ := mime.ParseMediaType(w.Header().Get("content-type"))
+	if mt != "multipart/byteranges" {
+		t.Fatalf("content-type = %q; want multipart/byteranges", mt)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	want := []struct{ body, contentRange string }{
+		{"01", "bytes 0-1/10"},
+		{"56", "bytes 5-6/10"},
+	}
+	for i, p := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("%d: NextPart: %v", i, err)
+		}
+		if v := part.Header.Get("content-range"); v != p.contentRange {
+			t.Errorf("%d: content-range = %q; want %q", i, v, p.contentRange)
+		}
+		if v := part.Header.Get("content-type"); v != "text/plain" {
+			t.Errorf("%d: content-type = %q; want text/plain", i, v)
+		}
+		if b, _ := ioutil.ReadAll(part); string(b) != p.body {
+			t.Errorf("%d: part body = %q; want %q", i, b, p.body)
+		}
+	}
+}
+
+func TestServeRangeForward(t *testing.T) {
+	body := strings.Repeat("x", cacheItemMax) + "tail"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer ts.Close()
+
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
+	tests := []struct {
+		rng, body, contentRange string
+		code                    int
+	}{
+		{"bytes=1048576-1048578", "tai", "bytes 1048576-1048578/1048580", http.StatusPartialContent},
+		{"bytes=-4", "tail", "bytes 1048576-1048579/1048580", http.StatusPartialContent},
+		{"bytes=2000000-", "", "bytes */1048580", http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, test := range tests {
+		o, err := stor.Open(context.Background(), "bucket", "large")
+		if err != nil {
+			t.Fatalf("stor.Open: %v", err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("range", test.rng)
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, o); err != nil {
+			t.Fatalf("%s: %v", test.rng, err)
+		}
+		o.Body.Close()
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.rng, w.Code, test.code)
+		}
+		if v := w.Body.String(); v != test.body {
+			t.Errorf("%s: w.Body = %q; want %q", test.rng, v, test.body)
+		}
+		if v := w.Header().Get("content-range"); v != test.contentRange {
+			t.Errorf("%s: content-range = %q; want %q", test.rng, v, test.contentRange)
+		}
+	}
+}
+
+func TestServeRangeForwardChanged(t *testing.T) {
+	body := strings.Repeat("x", cacheItemMax) + "tail"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "" {
+			// a newer version of the object
+			w.Header().Set("etag", `"v2"`)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(strings.ToUpper(body)))
+			return
+		}
+		w.Header().Set("etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer ts.Close()
+
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
+	o, err := stor.Open(context.Background(), "bucket", "large")
+	if err != nil {
+		t.Fatalf("stor.Open: %v", err)
+	}
+	defer o.Body.Close()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("range", "bytes=-4")
+	w := httptest.NewRecorder()
+	if err := stor.ServeObject(w, r, o); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusOK)
+	}
+	if w.Body.String() != body {
+		t.Errorf("w.Body is not the original version of %d bytes", len(body))
+	}
+	if v := w.Header().Get("etag"); v != `"v1"` {
+		t.Errorf("etag = %q; want \"v1\"", v)
+	}
+}
+
+func TestServeRangeFill(t *testing.T) {
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var full, ranged int32
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		} else {
+			atomic.AddInt32(&full, 1)
+		}
+		w.Header().Set("content-type", "video/mp4")
+		w.Header().Set("etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer gcs.Close()
+
+	stor := &Storage{Base: gcs.URL, Cache: NewLRU(8 << 20)}
+	ctx := context.Background()
+	cached := func() {
+		// large objects are cached in background
+		key := stor.objectKey(ctx, "bucket", "video.mp4")
+		for i := 0; ; i++ {
+			b, err := stor.getCache(ctx, key)
+			flights.Lock()
+			_, busy := flights.m[key]
+			flights.Unlock()
+			if err == nil && b.Chunks > 0 && !busy {
+				return
+			}
+			if i == 1000 {
+				t.Fatal("video.mp4 is not cached")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	tests := []struct {
+		rng          string
+		start, end   int
+		full, ranged int32
+		purge        bool
+	}{
+		// a range at the start of an uncached object is served as it is cached
+		{"bytes=0-", 0, len(data), 1, 0, false},
+		{"bytes=0-", 0, len(data), 1, 0, false},
+		{"bytes=100-199", 100, 200, 1, 0, false},
+		{"bytes=0-1", 0, 2, 2, 0, true},
+		{"bytes=1000-1999", 1000, 2000, 2, 0, false},
+		// other ranges are forwarded while the object is cached
+		{"bytes=-100", len(data) - 100, len(data), 3, 1, true},
+		{"bytes=2000-2999", 2000, 3000, 3, 1, false},
+	}
+	for i, test := range tests {
+		if test.purge {
+			stor.PurgeCache(ctx, "bucket", "video.mp4")
+		}
+		o, err := stor.Open(ctx, "bucket", "video.mp4")
+		if err != nil {
+			t.Fatalf("%d: stor.Open: %v", i, err)
+		}
+		r := httptest.NewRequest("GET", "/video.mp4", nil)
+		r.Header.Set("range", test.rng)
+		w := httptest.NewRecorder()
+		if err := stor.ServeObject(w, r, o); err != nil {
+			t.Fatalf("%d: %s: %v", i, test.rng, err)
+		}
+		o.Body.Close()
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%d: %s: w.Code = %d; want %d", i, test.rng, w.Code, http.StatusPartialContent)
+		}
+		if !bytes.Equal(w.Body.Bytes(), data[test.start:test.end]) {
+			t.Errorf("%d: %s: body mismatch", i, test.rng)
+		}
+		f, rg := atomic.LoadInt32(&full), atomic.LoadInt32(&ranged)
+		if f != test.full || rg != test.ranged {
+			t.Errorf("%d: %s: full = %d, ranged = %d; want %d, %d", i, test.rng, f, rg, test.full, test.ranged)
+		}
+		cached()
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisTimeout limits a single Redis command duration
+// when the context has no deadline.
+const redisTimeout = 2 * time.Second
+
+// Redis is a Cache which talks Redis protocol, e.g. to Cloud Memorystore.
+// It keeps a small pool of idle connections and is safe for concurrent use.
+type Redis struct {
+	Addr     string // server address, e.g. "10.0.0.3:6379"
+	Password string // optional AUTH password
+	DB       int    // database number to SELECT
+	MaxIdle  int    // max idle connections; zero means 8
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// Get implements Cache.Get.
+func (c *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := c.do(ctx, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrCacheMiss
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", v)
+	}
+	return b, nil
+}
+
+// Set implements Cache.Set.
+func (c *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte(key), value}
+	if ms := ttl.Nanoseconds() / 1e6; ms > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(ms, 10)))
+	}
+	_, err := c.do(ctx, "SET", args...)
+	return err
+}
+
+// Delete implements Cache.Delete.
+func (c *Redis) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", []byte(key))
+	return err
+}
+
+// do sends a single command to the server and returns its reply.
+// The reply is one of nil, string, int64, []byte or []interface{}.
+func (c *Redis) do(ctx context.Context, cmd string, args ...[]byte) (interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	cn.SetDeadline(deadline)
+	v, err := cn.do(cmd, args...)
+	if _, isReplyErr := err.(redisError); err != nil && !isReplyErr {
+		// the connection state is unknown
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return v, err
+}
+
+// get returns an idle connection or dials a new one.
+func (c *Redis) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.SetDeadline(deadline)
+	} else {
+		cn.SetDeadline(time.Now().Add(redisTimeout))
+	}
+	if c.Password != "" {
+		if _, err := cn.do("AUTH", []byte(c.Password)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.DB != 0 {
+		if _, err := cn.do("SELECT", []byte(strconv.Itoa(c.DB))); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put returns cn to the idle pool or closes it if the pool is full.
+func (c *Redis) put(cn *redisConn) {
+	max := c.MaxIdle
+	if max == 0 {
+		max = 8
+	}
+	c.mu.Lock()
+	if len(c.idle) < max {
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+	if cn != nil {
+		cn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a single connection speaking RESP protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (cn *redisConn) do(cmd string, args ...[]byte) (interface{}, error) {
+	w := bufio.NewWriter(cn.Conn)
+	fmt.Fprintf(w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(a))
+		w.Write(a)
+		w.WriteString("\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+func (cn *redisConn) readReply() (interface{}, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2) // including trailing \r\n
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = cn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+func (cn *redisConn) readLine() ([]byte, error) {
+	line, err := cn.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
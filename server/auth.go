@@ -0,0 +1,231 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/weasel"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	// googleJWKS is the default JWKS URL of Google-signed OIDC tokens.
+	googleJWKS = "https://www.googleapis.com/oauth2/v3/certs"
+	// jwksTTL is how long JWKS keys are reused before they're fetched again.
+	jwksTTL = time.Hour
+	// jwksMinRefresh limits JWKS refetches on unknown key IDs.
+	jwksMinRefresh = time.Minute
+	// jwtLeeway allows for clock skew when checking token times.
+	jwtLeeway = time.Minute
+)
+
+// tokenAuth returns a handler which requires requests to carry the secret
+// in the header before calling h, such as the channel token
+// of Object Change Notifications in X-Goog-Channel-Token.
+func tokenAuth(header, secret string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(header)
+		if subtle.ConstantTimeCompare([]byte(v), []byte(secret)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// oidcAuth verifies Google-signed OIDC tokens of Pub/Sub push requests.
+type oidcAuth struct {
+	jwksURL  string   // JWKS location
+	audience string   // expected "aud" claim; push endpoint URL if empty
+	emails   []string // allowed "email" claims; none if empty
+	errorf   func(ctx context.Context, format string, args ...interface{})
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey // by key ID
+	expires time.Time                 // keys expiration
+	fetched time.Time                 // last fetch time
+}
+
+// handler returns a handler which requires requests to carry a valid
+// bearer token before calling h.
+func (a *oidcAuth) handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := weasel.NewContext(r)
+		aud := a.audience
+		if aud == "" {
+			aud = "https://" + r.Host + r.URL.Path
+		}
+		tok := r.Header.Get("Authorization")
+		if !strings.HasPrefix(tok, "Bearer ") {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if err := a.verify(ctx, tok[len("Bearer "):], aud); err != nil {
+			a.errorf(ctx, "%s: %v", r.URL.Path, err)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// verify checks RS256 signature and claims of the JWT token.
+func (a *oidcAuth) verify(ctx context.Context, token, aud string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg, Kid string
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+
+	var claims struct {
+		Iss           string
+		Aud           string
+		Exp, Iat      int64
+		Email         string
+		EmailVerified bool `json:"email_verified"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case claims.Iss != "https://accounts.google.com" && claims.Iss != "accounts.google.com":
+		return fmt.Errorf("invalid iss %q", claims.Iss)
+	case claims.Aud != aud:
+		return fmt.Errorf("invalid aud %q; want %q", claims.Aud, aud)
+	case now.After(time.Unix(claims.Exp, 0).Add(jwtLeeway)):
+		return errors.New("token expired")
+	case now.Add(jwtLeeway).Before(time.Unix(claims.Iat, 0)):
+		return errors.New("token used before issued")
+	}
+	for _, e := range a.emails {
+		if claims.Email == e && claims.EmailVerified {
+			return nil
+		}
+	}
+	return fmt.Errorf("email %q not allowed", claims.Email)
+}
+
+// key returns the public key kid, fetching JWKS if needed.
+func (a *oidcAuth) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	k := a.keys[kid]
+	if k != nil && now.Before(a.expires) {
+		return k, nil
+	}
+	if k == nil && now.Sub(a.fetched) < jwksMinRefresh && now.Before(a.expires) {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	keys, err := fetchJWKS(ctx, a.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	a.keys, a.expires, a.fetched = keys, now.Add(jwksTTL), now
+	if k = keys[kid]; k == nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// fetchJWKS retrieves RSA keys of the JSON Web Key Set at url.
+func fetchJWKS(ctx context.Context, url string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if appengine.IsStandard() {
+		client = urlfetch.Client(ctx)
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: %s", res.Status)
+	}
+	var body struct {
+		Keys []struct{ Kty, Kid, N, E string }
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range body.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
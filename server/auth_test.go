@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenAuth(t *testing.T) {
+	h := tokenAuth("X-Goog-Channel-Token", "secret", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, tok := range []string{"", "wrong", "secret"} {
+		r := httptest.NewRequest("POST", "/hook", nil)
+		if tok != "" {
+			r.Header.Set("X-Goog-Channel-Token", tok)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		want := http.StatusUnauthorized
+		if tok == "secret" {
+			want = http.StatusNoContent
+		}
+		if w.Code != want {
+			t.Errorf("token %q: w.Code = %d; want %d", tok, w.Code, want)
+		}
+	}
+}
+
+func TestOIDCAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	sign := func(kid string, claims map[string]interface{}) string {
+		enc := func(v interface{}) string {
+			b, _ := json.Marshal(v)
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+		s := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+		sum := sha256.Sum256([]byte(s))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	now := time.Now().Unix()
+	claims := func(aud, email string, exp int64) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            aud,
+			"iat":            now - 10,
+			"exp":            exp,
+			"email":          email,
+			"email_verified": true,
+		}
+	}
+	const (
+		aud   = "https://example.com/push"
+		email = "push@project.iam.gserviceaccount.com"
+	)
+	tests := []struct {
+		desc, auth string
+		code       int
+	}{
+		{"valid", "Bearer " + sign("k1", claims(aud, email, now+3600)), http.StatusNoContent},
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong aud", "Bearer " + sign("k1", claims("https://other/push", email, now+3600)), http.StatusUnauthorized},
+		{"wrong email", "Bearer " + sign("k1", claims(aud, "evil@example.com", now+3600)), http.StatusUnauthorized},
+		{"expired", "Bearer " + sign("k1", claims(aud, email, now-3600)), http.StatusUnauthorized},
+		{"unknown key", "Bearer " + sign("k2", claims(aud, email, now+3600)), http.StatusUnauthorized},
+		{"bad signature", "Bearer " + sign("k1", claims(aud, email, now+3600)) + "AA", http.StatusUnauthorized},
+	}
+
+	a := &oidcAuth{
+		jwksURL: jwks.URL,
+		emails:  []string{email},
+		errorf: func(ctx context.Context, format string, args ...interface{}) {
+			t.Logf(format, args...)
+		},
+	}
+	h := a.handler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", aud, nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.desc, w.Code, test.code)
+		}
+	}
+	if a.keys == nil || a.keys["k1"] == nil {
+		t.Errorf("a.keys = %v; want k1", a.keys)
+	}
+
+	// tokens of any service account are rejected without allowed emails
+	a.emails = nil
+	r := httptest.NewRequest("POST", aud, nil)
+	r.Header.Set("Authorization", tests[0].auth)
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no emails: w.Code = %d; want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// headerRule sets response headers of paths matching a pattern.
+type headerRule struct {
+	host    string   // host name or empty for all hosts
+	path    string   // original path pattern
+	pattern []string // path segments, see matchPath
+	headers map[string]string
+}
+
+// parseHeaderRules parses Config.Headers, ordered so that rules of more
+// specific patterns come later: host-specific rules after others,
+// longer paths after shorter ones.
+func parseHeaderRules(conf map[string]map[string]string) ([]*headerRule, error) {
+	var rules []*headerRule
+	for k, h := range conf {
+		i := strings.IndexByte(k, '/')
+		if i < 0 {
+			return nil, fmt.Errorf("header rule %q: no path", k)
+		}
+		rule := &headerRule{
+			host:    hostname(k[:i]),
+			path:    k[i:],
+			pattern: splitPath(k[i:]),
+			headers: h,
+		}
+		for j, seg := range rule.pattern {
+			if seg == "*" && j != len(rule.pattern)-1 {
+				return nil, fmt.Errorf("header rule %q: splat must be last", k)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		switch {
+		case (a.host == "") != (b.host == ""):
+			return a.host == ""
+		case len(a.path) != len(b.path):
+			return len(a.path) < len(b.path)
+		}
+		return a.host+a.path < b.host+b.path
+	})
+	return rules, nil
+}
+
+// setHeaders sets response headers of header rules matching request r.
+// Empty header values remove the header.
+func (s *server) setHeaders(w http.ResponseWriter, r *http.Request) {
+	if len(s.headers) == 0 {
+		return
+	}
+	host := hostname(r.Host)
+	h := w.Header()
+	for _, rule := range s.headers {
+		if rule.host != "" && rule.host != host || !matchPath(rule.pattern, r.URL.Path, nil) {
+			continue
+		}
+		for k, v := range rule.headers {
+			if v == "" {
+				h.Del(k)
+				continue
+			}
+			h.Set(k, v)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/weasel"
+)
+
+func TestServeHeaders(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/page.html", "/bucket/guide/intro":
+			w.Header().Set("content-language", "fr")
+			w.Write([]byte(r.URL.Path))
+		case "/bucket/embed/widget.html":
+			w.Write([]byte(r.URL.Path))
+		case "/bucket/framed.html":
+			w.Header().Set("x-goog-meta-header-x-frame-options", "SAMEORIGIN")
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	rules, err := parseHeaderRules(map[string]map[string]string{
+		"/*":                           {"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"},
+		"/embed/*":                     {"X-Frame-Options": ""},
+		"docs.example.com/guide/:page": {"Content-Language": "en"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		storage: &weasel.Storage{Base: gcs.URL, Headers: []string{"content-language"}},
+		buckets: map[string]string{"default": "bucket", "docs.example.com": "bucket"},
+		headers: rules,
+	}
+
+	tests := []struct {
+		host, path                      string
+		frameOptions, nosniff, language string
+	}{
+		{"example.com", "/page.html", "DENY", "nosniff", "fr"},
+		{"example.com", "/missing.html", "DENY", "nosniff", ""},
+		{"example.com", "/embed/widget.html", "", "nosniff", ""},
+		{"example.com", "/framed.html", "SAMEORIGIN", "nosniff", ""},
+		{"docs.example.com", "/guide/missing", "DENY", "nosniff", "en"},
+		{"docs.example.com", "/guide/intro", "DENY", "nosniff", "fr"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		h := w.Header()
+		if v := h.Get("x-frame-options"); v != test.frameOptions {
+			t.Errorf("%s%s: x-frame-options = %q; want %q", test.host, test.path, v, test.frameOptions)
+		}
+		if v := h.Get("x-content-type-options"); v != test.nosniff {
+			t.Errorf("%s%s: x-content-type-options = %q; want %q", test.host, test.path, v, test.nosniff)
+		}
+		if v := h.Get("content-language"); v != test.language {
+			t.Errorf("%s%s: content-language = %q; want %q", test.host, test.path, v, test.language)
+		}
+	}
+
+	if _, err := parseHeaderRules(map[string]map[string]string{"nopath": nil}); err == nil {
+		t.Error("parseHeaderRules: no error for a pattern without path")
+	}
+}
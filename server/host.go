@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validBucket matches names allowed to be substituted into bucket templates.
+var validBucket = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// hostPattern is a compiled Config.Buckets key matching multiple hosts.
+type hostPattern struct {
+	key    string         // original Config.Buckets key
+	re     *regexp.Regexp // anchored host regexp
+	bucket string         // bucket template with {name} or {N} placeholders
+}
+
+// compileHostPatterns compiles Config.Buckets keys which are host patterns,
+// ordered by precedence: wildcards and templates before regexps,
+// longer patterns first.
+// It returns an error if a pattern is invalid.
+func compileHostPatterns(buckets map[string]string) ([]*hostPattern, error) {
+	var pp []*hostPattern
+	for k, b := range buckets {
+		var expr string
+		switch {
+		case strings.HasPrefix(k, "~"):
+			expr = k[1:]
+		case strings.ContainsAny(k, "*{"):
+			expr = wildcardExpr(k)
+		default:
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("host pattern %q: %v", k, err)
+		}
+		pp = append(pp, &hostPattern{key: k, re: re, bucket: b})
+	}
+	sort.Slice(pp, func(i, j int) bool {
+		ri, rj := strings.HasPrefix(pp[i].key, "~"), strings.HasPrefix(pp[j].key, "~")
+		switch {
+		case ri != rj:
+			return rj
+		case len(pp[i].key) != len(pp[j].key):
+			return len(pp[i].key) > len(pp[j].key)
+		}
+		return pp[i].key < pp[j].key
+	})
+	return pp, nil
+}
+
+// wildcardExpr converts a host pattern such as "{sub}.preview.example.com"
+// or "*.example.com" to a regexp. A {name} placeholder matches a single
+// host label, while "*" matches one or more labels.
+func wildcardExpr(pattern string) string {
+	const label = `[a-z0-9_-]+`
+	var buf strings.Builder
+	buf.WriteByte('^')
+	for pattern != "" {
+		switch i := strings.IndexAny(pattern, "*{"); {
+		case i < 0:
+			buf.WriteString(regexp.QuoteMeta(pattern))
+			pattern = ""
+		case pattern[i] == '*':
+			buf.WriteString(regexp.QuoteMeta(pattern[:i]))
+			buf.WriteString(`(` + label + `(?:\.` + label + `)*)`)
+			pattern = pattern[i+1:]
+		default:
+			j := strings.IndexByte(pattern[i:], '}')
+			if j < 0 {
+				buf.WriteString(regexp.QuoteMeta(pattern))
+				pattern = ""
+				break
+			}
+			buf.WriteString(regexp.QuoteMeta(pattern[:i]))
+			buf.WriteString(`(?P<` + pattern[i+1:i+j] + `>` + label + `)`)
+			pattern = pattern[i+j+1:]
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// match returns the bucket of the host, substituting the pattern captures
+// into the bucket template. It returns false if the host doesn't match
+// or the substituted bucket name is invalid.
+func (p *hostPattern) match(host string) (string, bool) {
+	m := p.re.FindStringSubmatch(host)
+	if m == nil {
+		return "", false
+	}
+	b := p.bucket
+	for i, name := range p.re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		v := strings.ToLower(m[i])
+		b = strings.Replace(b, "{"+strconv.Itoa(i)+"}", v, -1)
+		if name != "" {
+			b = strings.Replace(b, "{"+name+"}", v, -1)
+		}
+	}
+	if !validBucket.MatchString(b) {
+		return "", false
+	}
+	return b, true
+}
+
+// hostname returns host without a port and a trailing dot, in lower case.
+func hostname(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestBucketForHost(t *testing.T) {
+	buckets := map[string]string{
+		"default":                        "default-bucket",
+		"example.com":                    "www",
+		"localhost:8080":                 "local",
+		"*.example.com":                  "wild",
+		"{sub}.preview.example.com":      "preview-{sub}",
+		"{a}.{b}.multi.example.com":      "{b}-{a}",
+		"~^pr-([0-9]+)[.]example[.]org$": "pr-{1}",
+	}
+	hosts, err := compileHostPatterns(buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{buckets: buckets, hosts: hosts}
+	tests := []struct{ host, bucket string }{
+		{"example.com", "www"},
+		{"example.com:443", "www"},
+		{"EXAMPLE.com.", "www"},
+		{"localhost:8080", "local"},
+		{"localhost:9090", "default-bucket"},
+		{"a.example.com", "wild"},
+		{"a.b.example.com", "wild"},
+		{"feature-x.preview.example.com", "preview-feature-x"},
+		{"Feature-X.preview.example.com:8080", "preview-feature-x"},
+		{"a.b.preview.example.com", "wild"},
+		{"x.y.multi.example.com", "y-x"},
+		{"pr-42.example.org", "pr-42"},
+		{"pr-x.example.org", "default-bucket"},
+		{"other.org", "default-bucket"},
+		{"[::1]:8080", "default-bucket"},
+	}
+	for _, test := range tests {
+		if b := s.bucketForHost(test.host); b != test.bucket {
+			t.Errorf("bucketForHost(%q) = %q; want %q", test.host, b, test.bucket)
+		}
+	}
+
+	if _, err := compileHostPatterns(map[string]string{"~(": "b"}); err == nil {
+		t.Error("compileHostPatterns: no error for invalid regexp")
+	}
+}
+
+func TestHostname(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"example.com", "example.com"},
+		{"Example.COM:8080", "example.com"},
+		{"example.com.", "example.com"},
+		{"[::1]", "[::1]"},
+		{"[::1]:80", "[::1]"},
+	}
+	for _, test := range tests {
+		if v := hostname(test.in); v != test.out {
+			t.Errorf("hostname(%q) = %q; want %q", test.in, v, test.out)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/weasel"
+)
+
+// mount maps a URL path prefix to a bucket directory.
+type mount struct {
+	host   string // host name or empty for all hosts
+	path   string // URL path prefix ending with "/"
+	bucket string
+	prefix string // object name prefix, empty or ending with "/"
+}
+
+// parseMounts parses Config.Mounts, ordered by precedence:
+// host-specific mounts first, longer paths first.
+func parseMounts(mounts map[string]string) ([]*mount, error) {
+	var mm []*mount
+	for k, v := range mounts {
+		i := strings.IndexByte(k, '/')
+		if i < 0 {
+			return nil, fmt.Errorf("mount %q: no path", k)
+		}
+		m := &mount{host: hostname(k[:i]), path: k[i:]}
+		if !strings.HasSuffix(m.path, "/") {
+			m.path += "/"
+		}
+		v = strings.TrimPrefix(v, "gs://")
+		if i := strings.IndexByte(v, '/'); i >= 0 {
+			m.bucket, m.prefix = v[:i], strings.TrimLeft(v[i:], "/")
+		} else {
+			m.bucket = v
+		}
+		if m.bucket == "" {
+			return nil, fmt.Errorf("mount %q: no bucket", k)
+		}
+		if m.prefix != "" && !strings.HasSuffix(m.prefix, "/") {
+			m.prefix += "/"
+		}
+		mm = append(mm, m)
+	}
+	sort.Slice(mm, func(i, j int) bool {
+		a, b := mm[i], mm[j]
+		switch {
+		case (a.host == "") != (b.host == ""):
+			return a.host != ""
+		case len(a.path) != len(b.path):
+			return len(a.path) > len(b.path)
+		}
+		return a.host < b.host
+	})
+	return mm, nil
+}
+
+// mountFor returns the mount serving URL path p of the host,
+// or nil if p is outside of all mounts.
+// The mount path without the trailing "/" also matches.
+func (s *server) mountFor(host, p string) *mount {
+	host = hostname(host)
+	for _, m := range s.mounts {
+		if m.host != "" && m.host != host {
+			continue
+		}
+		if strings.HasPrefix(p, m.path) || p+"/" == m.path {
+			return m
+		}
+	}
+	return nil
+}
+
+// objectName returns the object name of URL path p within the mount.
+func (m *mount) objectName(p string) string {
+	return m.prefix + strings.TrimPrefix(p, m.path)
+}
+
+// fixRedirect rewrites a directory redirect of object oname, synthesized
+// by weasel.Storage.OpenFile, to the URL path p of the mount.
+func (m *mount) fixRedirect(o *weasel.Object, oname, p string) {
+	if m.path[1:] == m.prefix || o.Redirect() != path.Join("/", oname)+"/" {
+		return
+	}
+	meta := make(map[string]string, len(o.Meta))
+	for k, v := range o.Meta {
+		meta[k] = v
+	}
+	meta["x-goog-meta-redirect"] = p + "/"
+	o.Meta = meta
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/weasel"
+)
+
+func TestServeMounts(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/site/index.html", "/docs-bucket/v2/guide.html", "/docs-bucket/v2/index.html",
+			"/docs-bucket/v2/howto/index.html", "/docs-bucket/v2/404.html",
+			"/cdn-bucket/app.js", "/cdn-bucket/img/logo.png", "/cdn-bucket/local.js":
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	mounts, err := parseMounts(map[string]string{
+		"/docs/":                 "gs://docs-bucket/v2",
+		"/assets/":               "cdn-bucket",
+		"/assets/img/":           "gs://cdn-bucket/img/",
+		"localhost:8080/assets/": "cdn-bucket/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		storage:    &weasel.Storage{Base: gcs.URL, Index: "index.html"},
+		buckets:    map[string]string{"default": "site"},
+		errorPages: map[string]string{"404": "404.html"},
+		mounts:     mounts,
+	}
+
+	tests := []struct {
+		host, path, body string
+		code             int
+		location         string
+	}{
+		{"example.com", "/", "/site/index.html", http.StatusOK, ""},
+		{"example.com", "/docs/guide.html", "/docs-bucket/v2/guide.html", http.StatusOK, ""},
+		{"example.com", "/docs/", "/docs-bucket/v2/index.html", http.StatusOK, ""},
+		{"example.com", "/docs", "", http.StatusMovedPermanently, "/docs/"},
+		{"example.com", "/docs/howto", "", http.StatusMovedPermanently, "/docs/howto/"},
+		{"example.com", "/docs/missing", "/docs-bucket/v2/404.html", http.StatusNotFound, ""},
+		{"example.com", "/assets/app.js", "/cdn-bucket/app.js", http.StatusOK, ""},
+		{"example.com", "/assets/img/logo.png", "/cdn-bucket/img/logo.png", http.StatusOK, ""},
+		{"localhost:8080", "/assets/local.js", "/cdn-bucket/local.js", http.StatusOK, ""},
+		{"example.com", "/other.html", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s%s: w.Code = %d; want %d", test.host, test.path, w.Code, test.code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s%s: w.Body = %q; want %q", test.host, test.path, w.Body.String(), test.body)
+		}
+		if v := w.Header().Get("location"); v != test.location {
+			t.Errorf("%s%s: location = %q; want %q", test.host, test.path, v, test.location)
+		}
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	for _, k := range []string{"nopath", "/empty/"} {
+		if _, err := parseMounts(map[string]string{k: ""}); err == nil {
+			t.Errorf("parseMounts(%q): no error", k)
+		}
+	}
+	mm, err := parseMounts(map[string]string{
+		"/a":           "b1/x",
+		"/a/b/":        "b2",
+		"example.com/": "b3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mount{
+		{host: "example.com", path: "/", bucket: "b3"},
+		{path: "/a/b/", bucket: "b2"},
+		{path: "/a/", bucket: "b1", prefix: "x/"},
+	}
+	for i, m := range mm {
+		if *m != want[i] {
+			t.Errorf("%d: mount = %+v; want %+v", i, *m, want[i])
+		}
+	}
+}
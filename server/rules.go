@@ -0,0 +1,329 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rulesTTL is how long parsed redirect rules are used before
+	// the rules object is checked for changes.
+	rulesTTL = 10 * time.Second
+	// rulesMaxSize limits size of the redirect rules object.
+	rulesMaxSize = 1 << 20
+)
+
+// redirectRule is a single line of a redirect rules object, such as
+//
+//	/blog/:year/:slug  page=:n  /posts/:year-:slug?page=:n  302
+type redirectRule struct {
+	from  []string          // path segments, ":name" placeholders and a trailing "*"
+	query map[string]string // required query params, ":name" binds a value
+	to    string            // URL or path with ":name" and ":splat" placeholders
+	code  int               // redirect status code or 200 for rewrites
+	force bool              // applies even if the requested object exists
+}
+
+// ruleSet is a memoized redirect rules object of a bucket.
+type ruleSet struct {
+	rules   []*redirectRule
+	etag    string
+	expires time.Time
+}
+
+// ruleStore holds redirect rules of buckets.
+type ruleStore struct {
+	name string // rules object name
+
+	mu   sync.Mutex
+	sets map[string]*ruleSet // by bucket
+}
+
+// redirectRules returns redirect rules of the bucket, loading them
+// from the rules object if they haven't been checked for rulesTTL.
+// The rules object is read with storage OpenDecoded, so that updates are
+// picked up as soon as the object is purged from cache by change notifications.
+func (s *server) redirectRules(ctx context.Context, bucket string) []*redirectRule {
+	rr := s.rules
+	if rr == nil || rr.name == "" {
+		return nil
+	}
+	rr.mu.Lock()
+	rs := rr.sets[bucket]
+	rr.mu.Unlock()
+	now := time.Now()
+	if rs != nil && now.Before(rs.expires) {
+		return rs.rules
+	}
+
+	next := &ruleSet{expires: now.Add(rulesTTL)}
+	o, err := s.storage.OpenDecoded(ctx, bucket, rr.name)
+	switch {
+	case err == nil:
+		next.etag = o.Meta["etag"]
+		if rs != nil && next.etag != "" && next.etag == rs.etag {
+			next.rules = rs.rules
+			break
+		}
+		var errs []error
+		next.rules, errs = parseRules(io.LimitReader(o.Body, rulesMaxSize))
+		for _, err := range errs {
+			s.errorf(ctx, "%s/%s: %v", bucket, rr.name, err)
+		}
+	case !isMissing(err) && rs != nil:
+		// keep using the last known rules
+		s.errorf(ctx, "%s/%s: %v", bucket, rr.name, err)
+		next.rules, next.etag = rs.rules, rs.etag
+	case !isMissing(err):
+		s.errorf(ctx, "%s/%s: %v", bucket, rr.name, err)
+	}
+	if o != nil {
+		o.Body.Close()
+	}
+
+	rr.mu.Lock()
+	if rr.sets == nil {
+		rr.sets = make(map[string]*ruleSet)
+	}
+	rr.sets[bucket] = next
+	rr.mu.Unlock()
+	return next.rules
+}
+
+// parseRules parses redirect rules in a format similar to Netlify _redirects
+// files. Each line is a rule of the form
+//
+//	from [param=value ...] to [status[!]]
+//
+// where from is a path, possibly with ":name" segment placeholders
+// and a trailing "*" splat, params are query conditions with values
+// or ":name" placeholders, and to is a path or a URL which can refer to
+// the placeholders, including ":splat". Status is one of 301 (default),
+// 302, 303, 307, 308 or 200, which serves to in place of from.
+// A "!" suffix forces the rule even if the requested object exists.
+// Empty lines and lines starting with "#" are ignored.
+//
+// Invalid rules are skipped and reported in the returned errors.
+func parseRules(r io.Reader) ([]*redirectRule, []error) {
+	var (
+		rules []*redirectRule
+		errs  []error
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(strings.Fields(line))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", n, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return rules, errs
+}
+
+// parseRule parses fields of a single rule line.
+func parseRule(f []string) (*redirectRule, error) {
+	if !strings.HasPrefix(f[0], "/") {
+		return nil, fmt.Errorf("invalid path %q", f[0])
+	}
+	rule := &redirectRule{from: splitPath(f[0]), code: http.StatusMovedPermanently}
+	for i, seg := range rule.from {
+		if seg == "*" && i != len(rule.from)-1 {
+			return nil, fmt.Errorf("splat must be last in %q", f[0])
+		}
+	}
+	f = f[1:]
+	for len(f) > 0 && strings.Contains(f[0], "=") && !strings.HasPrefix(f[0], "/") && !strings.Contains(f[0], "://") {
+		if rule.query == nil {
+			rule.query = make(map[string]string)
+		}
+		kv := strings.SplitN(f[0], "=", 2)
+		rule.query[kv[0]] = kv[1]
+		f = f[1:]
+	}
+	if len(f) == 0 {
+		return nil, fmt.Errorf("missing target")
+	}
+	rule.to, f = f[0], f[1:]
+	if len(f) > 0 {
+		code := f[0]
+		if strings.HasSuffix(code, "!") {
+			code, rule.force = code[:len(code)-1], true
+		}
+		var err error
+		if rule.code, err = strconv.Atoi(code); err != nil {
+			return nil, fmt.Errorf("invalid status %q", f[0])
+		}
+		f = f[1:]
+	}
+	switch rule.code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// ok
+	case http.StatusOK:
+		if !strings.HasPrefix(rule.to, "/") {
+			return nil, fmt.Errorf("rewrite target %q is not a path", rule.to)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported status %d", rule.code)
+	}
+	if len(f) > 0 {
+		return nil, fmt.Errorf("unexpected %q", strings.Join(f, " "))
+	}
+	return rule, nil
+}
+
+// matchRule returns the first of the rules matching URL path p and query,
+// along with the expanded rule target.
+// Only forced rules are matched if force is true, and only other rules
+// otherwise.
+func matchRule(rules []*redirectRule, p, query string, force bool) (*redirectRule, string) {
+	if len(rules) == 0 {
+		return nil, ""
+	}
+	q, _ := url.ParseQuery(query)
+	for _, rule := range rules {
+		if rule.force != force {
+			continue
+		}
+		if to, ok := rule.match(p, query, q); ok {
+			return rule, to
+		}
+	}
+	return nil, ""
+}
+
+// match reports whether the rule matches URL path p and query q,
+// parsed from the raw query, and returns the rule target with placeholders
+// substituted. The raw query is preserved for redirects to targets without
+// a query, unless the rule has query conditions.
+func (rule *redirectRule) match(p, query string, q url.Values) (string, bool) {
+	params := make(map[string]string)
+	if !matchPath(rule.from, p, params) {
+		return "", false
+	}
+	for k, v := range rule.query {
+		vv, ok := q[k]
+		if !ok {
+			return "", false
+		}
+		switch {
+		case strings.HasPrefix(v, ":"):
+			params[v[1:]] = url.QueryEscape(vv[0])
+		case v != vv[0]:
+			return "", false
+		}
+	}
+
+	to := expandParams(rule.to, params)
+	if rule.code != http.StatusOK && len(rule.query) == 0 && query != "" && !strings.Contains(to, "?") {
+		to += "?" + query
+	}
+	return to, true
+}
+
+// matchPath reports whether URL path p matches the pattern segments,
+// which can be ":name" placeholders and a trailing "*" splat.
+// Escaped values of the placeholders and the splat are stored in params,
+// if it is not nil.
+func matchPath(pattern []string, p string, params map[string]string) bool {
+	segs := splitPath(p)
+	n := len(pattern)
+	if n > 0 && pattern[n-1] == "*" {
+		if len(segs) < n-1 {
+			return false
+		}
+		if params != nil {
+			params["splat"] = escapePath(strings.Join(segs[n-1:], "/"))
+		}
+		n--
+	} else if len(segs) != n {
+		return false
+	}
+	for i, seg := range pattern[:n] {
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			if params != nil {
+				params[seg[1:]] = url.PathEscape(segs[i])
+			}
+		case seg != segs[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// expandParams replaces ":name" placeholders in s with params values.
+// Unknown placeholders are left intact.
+func expandParams(s string, params map[string]string) string {
+	var buf strings.Builder
+	for {
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			buf.WriteString(s)
+			return buf.String()
+		}
+		buf.WriteString(s[:i])
+		j := i + 1
+		for j < len(s) && isParamChar(s[j]) {
+			j++
+		}
+		if v, ok := params[s[i+1:j]]; ok && j > i+1 {
+			buf.WriteString(v)
+		} else {
+			buf.WriteString(s[i:j])
+		}
+		s = s[j:]
+	}
+}
+
+func isParamChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// splitPath returns segments of URL path p, ignoring a trailing "/".
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// escapePath escapes segments of path p.
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/weasel"
+)
+
+func TestParseRules(t *testing.T) {
+	const rules = `
+# comment
+/old/*             /new/:splat
+/blog/:year/:slug  /posts/:year-:slug  302
+/search  q=:q  type=doc  /find/:q  307
+/app/*   /app/index.html  200
+/legacy  https://example.org/  308!
+
+old/path  /new
+/a/*/b  /c
+/x
+/y  /z  404
+/y  /z  abc
+/r  https://example.org/  200
+/y  /z  301  extra
+`
+	rr, errs := parseRules(strings.NewReader(rules))
+	if len(rr) != 5 {
+		t.Errorf("len(rules) = %d; want 5", len(rr))
+	}
+	if len(errs) != 7 {
+		t.Errorf("errs = %v; want 7 errors", errs)
+	}
+	if len(rr) < 5 {
+		return
+	}
+	if r := rr[0]; r.code != http.StatusMovedPermanently || r.force || r.to != "/new/:splat" {
+		t.Errorf("rules[0] = %+v", r)
+	}
+	if r := rr[2]; r.code != http.StatusTemporaryRedirect || r.query["q"] != ":q" || r.query["type"] != "doc" {
+		t.Errorf("rules[2] = %+v", r)
+	}
+	if r := rr[4]; r.code != http.StatusPermanentRedirect || !r.force {
+		t.Errorf("rules[4] = %+v", r)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules, errs := parseRules(strings.NewReader(`
+/old/*             /new/:splat
+/blog/:year/:slug  /posts/:year-:slug  302
+/search  q=:q  type=doc  /find/:q  307
+/             /home   302
+/forced       /f      301!
+`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		path, query string
+		force       bool
+		to          string
+	}{
+		{"/old", "", false, "/new/"},
+		{"/old/a/b c", "", false, "/new/a/b%20c"},
+		{"/old/a", "x=1&y=2", false, "/new/a?x=1&y=2"},
+		{"/blog/2019/hello/", "", false, "/posts/2019-hello"},
+		{"/blog/2019", "", false, ""},
+		{"/search", "type=doc&q=go", false, "/find/go"},
+		{"/search", "q=go", false, ""},
+		{"/search", "type=img&q=go", false, ""},
+		{"/", "", false, "/home"},
+		{"/forced", "", false, ""},
+		{"/forced", "", true, "/f"},
+		{"/other", "", false, ""},
+	}
+	for _, test := range tests {
+		_, to := matchRule(rules, test.path, test.query, test.force)
+		if to != test.to {
+			t.Errorf("matchRule(%q, %q, %v) = %q; want %q", test.path, test.query, test.force, to, test.to)
+		}
+	}
+}
+
+func TestServeRedirectRules(t *testing.T) {
+	var mu sync.Mutex
+	rules, etag := `
+/old/*        /new/:splat
+/exists.html  /elsewhere        302
+/forced.html  /forced-target    302!
+/app/*        /app/index.html   200
+/docs-alias/* /docs/:splat      200
+`, `"v1"`
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/bucket/_redirects":
+			w.Header().Set("etag", etag)
+			w.Write([]byte(rules))
+		case "/bucket/exists.html", "/bucket/forced.html", "/bucket/app/index.html", "/docs/v1/guide.html":
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	mounts, _ := parseMounts(map[string]string{"/docs/": "docs/v1/"})
+	stor := &weasel.Storage{Base: gcs.URL, Index: "index.html", Cache: weasel.NewLRU(1 << 20)}
+	srv := &server{
+		storage: stor,
+		buckets: map[string]string{"default": "bucket"},
+		mounts:  mounts,
+		rules:   &ruleStore{name: "_redirects"},
+	}
+
+	tests := []struct {
+		path, body string
+		code       int
+		location   string
+	}{
+		{"/old/page?x=1", "", http.StatusMovedPermanently, "/new/page?x=1"},
+		{"/exists.html", "/bucket/exists.html", http.StatusOK, ""},
+		{"/forced.html", "", http.StatusFound, "/forced-target"},
+		{"/app/users/1", "/bucket/app/index.html", http.StatusOK, ""},
+		{"/docs-alias/guide.html", "/docs/v1/guide.html", http.StatusOK, ""},
+		{"/missing", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.path, w.Code, test.code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: w.Body = %q; want %q", test.path, w.Body.String(), test.body)
+		}
+		if v := w.Header().Get("location"); v != test.location {
+			t.Errorf("%s: location = %q; want %q", test.path, v, test.location)
+		}
+	}
+
+	// reload after a change notification
+	mu.Lock()
+	rules, etag = "/old/* /newer/:splat 302", `"v2"`
+	mu.Unlock()
+	ctx := context.Background()
+	if err := stor.PurgeCache(ctx, "bucket", "_redirects"); err != nil {
+		t.Fatal(err)
+	}
+	srv.rules.sets["bucket"].expires = time.Now()
+	r := httptest.NewRequest("GET", "/old/page", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if v := w.Header().Get("location"); w.Code != http.StatusFound || v != "/newer/page" {
+		t.Errorf("reloaded: w.Code = %d, location = %q; want 302 and /newer/page", w.Code, v)
+	}
+}
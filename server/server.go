@@ -13,7 +13,8 @@
 // limitations under the License.
 
 // Package server provides a simple frontend in form of an App Engine app
-// built atop the weasel.Storage.
+// built atop the weasel.Storage. It can also run outside of App Engine
+// as a standalone server, see github.com/google/weasel/cmd/weasel.
 // See README.md for the design details.
 //
 // This package is a work in progress and makes no API stability promises.
@@ -41,32 +42,45 @@
 //        Buckets: map[string]string{
 //          "default": "my-gcs-bucket",
 //        },
-//        HookPath: "/-/flush-gcs-cache",
+//        HookPath:  "/-/flush-gcs-cache",
+//        HookToken: "channel-secret",
 //      }
 //      server.Init(nil, conf)
 //    }
 //
 // The "/-/flush-gcs-cache" needs to be hooked up with "my-gcs-bucket" manually
-// using Object Change Notifications. See the following page for more details:
+// using Object Change Notifications with "channel-secret" channel token.
+// See the following page for more details:
 // https://cloud.google.com/storage/docs/object-change-notification
+//
+// Alternatively, Config.PubSubPath can be set up as a Cloud Pub/Sub push
+// endpoint of a subscription to the bucket notifications topic.
+// See https://cloud.google.com/storage/docs/pubsub-notifications.
 package server
 
 import (
 	"context"
+	"html/template"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/weasel"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 )
 
-// Used to set STS header value when serving over TLS.
+// Used to set STS header value when serving over TLS,
+// unless Config.HSTS has a policy of the host.
 const stsValue = "max-age=10886400; includeSubDomains; preload"
 
 // Init registers server handlers on the provided mux.
 // If the mux argument is nil, http.DefaultServeMux is used.
+// It panics if conf.Buckets contains an invalid host pattern,
+// conf.Mounts an invalid mount, conf.Headers an invalid rule,
+// conf.TLSSource is unknown, or conf.HookPath or conf.PubSubPath
+// is set without its credentials.
 //
 // See package doc for a usage example.
 func Init(mux *http.ServeMux, conf *Config) {
@@ -77,16 +91,68 @@ func Init(mux *http.ServeMux, conf *Config) {
 		mux.Handle(host, redirectHandler(redir, http.StatusMovedPermanently))
 	}
 	s := &server{
-		storage: conf.Storage,
-		buckets: conf.Buckets,
-		tlsOnly: make(map[string]struct{}, len(conf.TLSOnly)),
+		storage:    conf.Storage,
+		buckets:    conf.Buckets,
+		errorPages: conf.ErrorPages,
+		spa:        conf.SPA,
+		rules:      &ruleStore{name: conf.RedirectRules},
+		autoIndex:  make(map[string]struct{}, len(conf.AutoIndex)),
+		tlsOnly:    make(map[string]struct{}, len(conf.TLSOnly)),
+		hsts:       make(map[string]*HSTS, len(conf.HSTS)),
+	}
+	hosts, err := compileHostPatterns(conf.Buckets)
+	if err != nil {
+		panic(err)
+	}
+	s.hosts = hosts
+	if s.mounts, err = parseMounts(conf.Mounts); err != nil {
+		panic(err)
+	}
+	if s.headers, err = parseHeaderRules(conf.Headers); err != nil {
+		panic(err)
+	}
+	if s.tlsSource, err = tlsSource(conf.TLSSource); err != nil {
+		panic(err)
+	}
+	if conf.HookPath != "" && conf.HookToken == "" {
+		panic("server: HookPath requires HookToken")
+	}
+	if conf.PubSubPath != "" && len(conf.PubSubEmails) == 0 {
+		panic("server: PubSubPath requires PubSubEmails")
 	}
 	for _, h := range conf.TLSOnly {
 		s.tlsOnly[h] = struct{}{}
 	}
+	for h, v := range conf.HSTS {
+		v := v
+		if h != "default" {
+			h = hostname(h)
+		}
+		s.hsts[h] = &v
+	}
+	for _, h := range conf.AutoIndex {
+		s.autoIndex[h] = struct{}{}
+	}
 	mux.Handle(conf.webroot(), s)
 	if conf.HookPath != "" {
-		mux.HandleFunc(conf.HookPath, conf.Storage.HandleChangeHook)
+		h := tokenAuth("X-Goog-Channel-Token", conf.HookToken, conf.Storage.HandleChangeHook)
+		mux.HandleFunc(conf.HookPath, h)
+	}
+	if conf.PubSubPath != "" {
+		a := &oidcAuth{
+			jwksURL:  conf.JWKSURL,
+			audience: conf.PubSubAudience,
+			emails:   conf.PubSubEmails,
+			errorf:   s.errorf,
+		}
+		if a.jwksURL == "" {
+			a.jwksURL = googleJWKS
+		}
+		mux.HandleFunc(conf.PubSubPath, a.handler(conf.Storage.HandlePubSubPush))
+	}
+	if conf.PurgePath != "" && conf.PurgeToken != "" {
+		h := tokenAuth("Authorization", "Bearer "+conf.PurgeToken, conf.Storage.HandlePurge)
+		mux.HandleFunc(conf.PurgePath, h)
 	}
 }
 
@@ -99,24 +165,150 @@ type Config struct {
 	// Buckets defines a mapping between hosts
 	// and GCS buckets the responses should be served from.
 	// The map must contain at least "default" key.
+	//
+	// Besides exact host names, keys can be host patterns:
+	// "*.example.com" matches hosts with one or more labels in place of "*",
+	// "{sub}.preview.example.com" matches a single label as "sub",
+	// and keys starting with "~" are regular expressions matching lower case
+	// host names, such as "~^(?P<sub>[a-z]+)-preview[.]example[.]com$".
+	// Values can refer to matched labels and regexp groups by name or
+	// number, e.g. "preview-{sub}" or "preview-{1}".
+	// Exact names take precedence over patterns, and longer patterns
+	// over shorter ones, with regular expressions tried last.
+	// Request host ports are ignored unless a key includes the port.
 	Buckets map[string]string
 
+	// Mounts maps URL path prefixes to bucket directories, so that a host
+	// can serve content of several buckets. For instance, "/docs/" mapped to
+	// "gs://docs-bucket/v2/" serves "/docs/guide.html" with "v2/guide.html"
+	// object of docs-bucket. Keys can start with a host name, such as
+	// "example.com/assets/", to apply to that host only.
+	// Host-specific mounts take precedence, then longer paths.
+	// Paths outside of mounts are served from Buckets.
+	// SPA fallbacks and error pages are relative to the mount directory.
+	Mounts map[string]string
+
 	// WebRoot is the content serving root pattern.
 	// If empty, default is used.
 	// Default value is "/".
 	WebRoot string
 
 	// GCS object change notification hook pattern.
-	// If empty, no hook handler will be setup during Init.
-	HookPath string
+	// Hook requests must carry HookToken, the secret token of the
+	// notification channel, in X-Goog-Channel-Token header.
+	// If HookPath is empty, no hook handler will be setup during Init.
+	// HookToken is required otherwise, and Init panics without it.
+	HookPath  string
+	HookToken string
+
+	// Cloud Pub/Sub push endpoint pattern, receiving GCS notifications.
+	// Push requests must carry a Google-signed OIDC token of one of
+	// PubSubEmails, see https://cloud.google.com/pubsub/docs/push#authentication.
+	// If empty, no push handler will be setup during Init.
+	// PubSubEmails are required otherwise, and Init panics without them.
+	PubSubPath string
+
+	// PubSubAudience is the expected audience of Pub/Sub push tokens.
+	// If empty, the push endpoint URL is expected, which is Pub/Sub default.
+	PubSubAudience string
+
+	// PubSubEmails are service accounts allowed to sign Pub/Sub push tokens.
+	// Any service account can obtain a token for an arbitrary audience,
+	// so the audience alone doesn't authenticate the sender.
+	PubSubEmails []string
+
+	// JWKSURL is the location of public keys used to verify Pub/Sub push
+	// tokens. If empty, Google OAuth2 certificates are used.
+	JWKSURL string
+
+	// PurgePath is an admin endpoint pattern for purging cached objects
+	// of a bucket by name or prefix, see weasel.Storage.HandlePurge.
+	// Requests must carry PurgeToken as a bearer token in Authorization
+	// header. The endpoint is not setup during Init if either is empty.
+	PurgePath  string
+	PurgeToken string
+
+	// Headers maps request path patterns to response headers, e.g.
+	// site-wide security headers:
+	//
+	//	"/*": {"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"},
+	//	"/embed/*": {"X-Frame-Options": ""},
+	//	"docs.example.com/guide/:page": {"Content-Language": "en"},
+	//
+	// Patterns can start with a host name, and have ":name" segment
+	// placeholders and a trailing "*" matching the rest of the path.
+	// Headers of all matching patterns are set, with more specific patterns
+	// overriding less specific ones: host-specific patterns, then longer ones.
+	// An empty value removes the header.
+	// Object headers, such as "x-goog-meta-header-NAME" custom metadata,
+	// take precedence, see weasel.Storage.Headers.
+	Headers map[string]map[string]string
 
 	// Redirects is a map of URLs the app will permanently redirect to
 	// when the request host and path match a key.
-	// Map values must not end with "/" and cannot contain query string.
+	// The request path is appended to the URL path, and the request query
+	// to the URL query, if any.
 	Redirects map[string]string
 
+	// RedirectRules is an object name of redirect rules in each bucket,
+	// e.g. "_redirects", in a format similar to Netlify _redirects files:
+	//
+	//	# from             [query]   to                 [status][!]
+	//	/old/*                       /new/:splat        301
+	//	/blog/:year/:slug            /posts/:year-:slug 302
+	//	/search            q=:q      /find/:q           307
+	//	/app/*                       /app/index.html    200
+	//	/legacy                      https://example.org/ 308!
+	//
+	// Rules of the host bucket apply to requested paths which don't have
+	// an object, in order, unless the status ends with "!", forcing the rule
+	// ahead of the object. The 200 status serves the target path in place
+	// of the requested one. Rules are reloaded when the object changes.
+	// If empty, no rules are loaded.
+	RedirectRules string
+
 	// TLSOnly forces TLS connection for the specified host names.
+	// A name can also be a wildcard such as "*.example.com", matching
+	// all subdomains, or "*" matching all hosts.
+	// Plain HTTP requests are redirected with 301 status for GET and HEAD
+	// methods, and 308 for others.
 	TLSOnly []string
+
+	// TLSSource is how the scheme of requests to TLSOnly hosts is determined:
+	// "X-Forwarded-Proto" (default) or "Forwarded" header set by a trusted
+	// proxy, or "TLS" for the server's own connection state.
+	// Requests of unknown scheme are neither redirected nor sent HSTS.
+	TLSSource string
+
+	// HSTS maps host names and wildcards of TLSOnly hosts to their
+	// Strict-Transport-Security policies, e.g.
+	//
+	//	"*.example.com": {MaxAge: 31536000, IncludeSubDomains: true}
+	//
+	// A "default" key applies to all other hosts. Hosts without a policy
+	// are sent a max-age of 126 days with includeSubDomains and preload.
+	HSTS map[string]HSTS
+
+	// ErrorPages maps response status codes to bucket objects
+	// served as the response body, e.g. "404": "404.html".
+	// A key can also be a class of codes, such as "5xx".
+	// Errors without a page are rendered with a built-in template.
+	ErrorPages map[string]string
+
+	// SPA enables single-page application mode for the hosts,
+	// mapping host names to a fallback object, e.g. "index.html".
+	// In this mode, missing objects without a file extension are served
+	// with the fallback object instead of a 404 or a directory redirect.
+	// A "default" key applies to all other hosts.
+	// Request host ports are ignored unless a key includes the port.
+	SPA map[string]string
+
+	// AutoIndex enables directory listings for the specified host names.
+	// Paths ending with "/" without an index object are served with
+	// an HTML listing of the bucket objects under the path, or a JSON one
+	// if the request has "format=json" query.
+	// Request host ports are ignored unless a name includes the port.
+	AutoIndex []string
 }
 
 func (c *Config) webroot() string {
@@ -133,10 +325,37 @@ type server struct {
 	// Contains hostnames forced to be server over TLS.
 	tlsOnly map[string]struct{}
 
+	// Source of the request scheme, see tlsSource.
+	tlsSource string
+
+	// Maps hosts to STS policies.
+	hsts map[string]*HSTS
+
 	// Defines a mapping between hosts
 	// and GCS buckets the responses should be served from.
 	// The map must contain at least "default" key.
 	buckets map[string]string
+
+	// Host patterns of buckets, in order of precedence.
+	hosts []*hostPattern
+
+	// Path mounts, in order of precedence.
+	mounts []*mount
+
+	// Redirect rules of buckets.
+	rules *ruleStore
+
+	// Response header rules, from least to most specific.
+	headers []*headerRule
+
+	// Maps status codes to bucket error page objects.
+	errorPages map[string]string
+
+	// Maps hosts to SPA fallback objects.
+	spa map[string]string
+
+	// Contains hostnames with directory listings enabled.
+	autoIndex map[string]struct{}
 }
 
 // ServeHTTP responds with a GCS object contents, preserving its original headers
@@ -146,73 +365,288 @@ type server struct {
 //
 // Only GET, HEAD and OPTIONS methods are allowed.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, forceTLS := s.tlsOnly[r.Host]
-	if forceTLS && r.Header.Get("X-Forwarded-Proto") == "https" {
-		w.Header().Set("Strict-Transport-Security", stsValue)
+	if s.forceTLS(r.Host) {
+		switch s.scheme(r) {
+		case "https":
+			w.Header().Set("Strict-Transport-Security", s.stsHeader(r.Host))
+		case "http":
+			redirectTLS(w, r)
+			return
+		}
 	}
+	s.setHeaders(w, r)
 	if !weasel.ValidMethod(r.Method) {
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
-	if forceTLS && r.Header.Get("X-Forwarded-Proto") == "http" {
-		u := "https://" + r.Host + r.URL.Path
-		if r.URL.RawQuery != "" {
-			u += "?" + r.URL.RawQuery
+
+	ctx, cancel := context.WithTimeout(weasel.NewContext(r), 10*time.Second)
+	defer cancel()
+	p := r.URL.Path
+	var rules []*redirectRule
+	if r.Method != "OPTIONS" {
+		rules = s.redirectRules(ctx, s.bucketForHost(r.Host))
+	}
+	if rule, to := matchRule(rules, p, r.URL.RawQuery, true); rule != nil {
+		if p = s.applyRule(w, r, rule, to); p == "" {
+			return
 		}
-		http.Redirect(w, r, u, http.StatusMovedPermanently)
+	}
+	t := s.resolve(w, r, p)
+	if t == nil {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(appengine.NewContext(r), 10*time.Second)
-	defer cancel()
-	bucket := s.bucketForHost(r.Host)
-	oname := r.URL.Path[1:]
-
-	o, err := s.storage.OpenFile(ctx, bucket, oname)
+	o, err := s.open(ctx, r, t)
+	if isMissing(err) {
+		if rule, to := matchRule(rules, p, r.URL.RawQuery, false); rule != nil {
+			if p = s.applyRule(w, r, rule, to); p == "" {
+				return
+			}
+			if t = s.resolve(w, r, p); t == nil {
+				return
+			}
+			o, err = s.open(ctx, r, t)
+		}
+	}
+	if isMissing(err) {
+		o, err = s.openFallback(ctx, r, t, err)
+	}
 	if err != nil {
 		code := http.StatusInternalServerError
 		if errf, ok := err.(*weasel.FetchError); ok {
 			code = errf.Code
 		}
-		serveError(w, code, "")
+		s.serveError(ctx, w, r, t.bucket, t.dir, code)
 		if code != http.StatusNotFound {
-			log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+			s.errorf(ctx, "%s/%s: %v", t.bucket, t.name, err)
 		}
 		return
 	}
+	if t.mount != nil {
+		t.mount.fixRedirect(o, t.name, p)
+	}
 	if err := s.storage.ServeObject(w, r, o); err != nil {
-		log.Errorf(ctx, "%s/%s: %v", bucket, oname, err)
+		s.errorf(ctx, "%s/%s: %v", t.bucket, t.name, err)
 	}
 	o.Body.Close()
 }
 
-// bucketForHost returns a bucket name mapped to the host.
+// target is a bucket object serving a URL path.
+type target struct {
+	bucket string
+	dir    string // mount directory, empty or ending with "/"
+	name   string // object name
+	mount  *mount // nil outside of mounts
+}
+
+// isDir reports whether t is a directory.
+func (t *target) isDir() bool {
+	return t.name == "" || strings.HasSuffix(t.name, "/")
+}
+
+// resolve returns the target of URL path p of request r.
+// Mount paths without the trailing "/" are redirected instead,
+// in which case resolve returns nil.
+func (s *server) resolve(w http.ResponseWriter, r *http.Request, p string) *target {
+	m := s.mountFor(r.Host, p)
+	if m == nil {
+		return &target{bucket: s.bucketForHost(r.Host), name: p[1:]}
+	}
+	if !strings.HasPrefix(p, m.path) {
+		u := m.path
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+		return nil
+	}
+	return &target{bucket: m.bucket, dir: m.prefix, name: m.objectName(p), mount: m}
+}
+
+// applyRule responds to r with a redirect to the rule target,
+// and returns an empty string. For rewrite rules, it returns
+// the URL path of the target instead.
+func (s *server) applyRule(w http.ResponseWriter, r *http.Request, rule *redirectRule, to string) string {
+	if rule.code != http.StatusOK {
+		http.Redirect(w, r, to, rule.code)
+		return ""
+	}
+	if i := strings.IndexByte(to, '?'); i >= 0 {
+		to = to[:i]
+	}
+	if p, err := url.PathUnescape(to); err == nil {
+		return p
+	}
+	return to
+}
+
+// open retrieves the target object using storage OpenFile.
+// In SPA mode, extensionless names are opened without directory redirects.
+func (s *server) open(ctx context.Context, r *http.Request, t *target) (*weasel.Object, error) {
+	if s.spaFallback(r.Host) != "" && !t.isDir() && path.Ext(t.name) == "" {
+		// avoid directory redirects of OpenFile
+		return s.storage.Open(ctx, t.bucket, t.name)
+	}
+	return s.storage.OpenFile(ctx, t.bucket, t.name)
+}
+
+// openFallback retrieves a substitute of the missing target object,
+// which failed to open with err.
+// Directories without an index object are listed if the host is in autoindex
+// mode, and extensionless misses are served with the SPA fallback object
+// of the target directory if the host is in SPA mode.
+// Otherwise, it returns err.
+func (s *server) openFallback(ctx context.Context, r *http.Request, t *target, err error) (*weasel.Object, error) {
+	if s.autoIndexed(r.Host) && t.isDir() {
+		f := weasel.ListHTML
+		if r.URL.Query().Get("format") == "json" {
+			f = weasel.ListJSON
+		}
+		o, lerr := s.storage.OpenList(ctx, t.bucket, t.name, r.URL.Query().Get("page"), f)
+		if !isMissing(lerr) {
+			return o, lerr
+		}
+	}
+	if fallback := s.spaFallback(r.Host); fallback != "" && path.Ext(t.name) == "" {
+		return s.storage.Open(ctx, t.bucket, t.dir+fallback)
+	}
+	return nil, err
+}
+
+// isMissing reports whether err is a FetchError of a nonexistent object.
+// Note that GCS may respond with 403 Forbidden for nonexistent objects.
+func isMissing(err error) bool {
+	ferr, ok := err.(*weasel.FetchError)
+	return ok && (ferr.Code == http.StatusNotFound || ferr.Code == http.StatusForbidden)
+}
+
+// spaFallback returns SPA fallback object name for the host,
+// or zero string if the host is not in SPA mode.
+func (s *server) spaFallback(host string) string {
+	if v, ok := s.spa[host]; ok {
+		return v
+	}
+	if v, ok := s.spa[hostname(host)]; ok {
+		return v
+	}
+	return s.spa["default"]
+}
+
+// autoIndexed reports whether directory listings are enabled for the host.
+func (s *server) autoIndexed(host string) bool {
+	if _, ok := s.autoIndex[host]; ok {
+		return true
+	}
+	_, ok := s.autoIndex[hostname(host)]
+	return ok
+}
+
+// bucketForHost returns a bucket name mapped to the host,
+// either exactly or by a host pattern.
 // Default bucket name is return if no match found.
 func (s *server) bucketForHost(host string) string {
 	if b, ok := s.buckets[host]; ok {
 		return b
 	}
+	name := hostname(host)
+	if b, ok := s.buckets[name]; ok {
+		return b
+	}
+	for _, p := range s.hosts {
+		if b, ok := p.match(name); ok {
+			return b
+		}
+	}
 	return s.buckets["default"]
 }
 
+// errorf reports an error using the storage logger.
+func (s *server) errorf(ctx context.Context, format string, args ...interface{}) {
+	l := s.storage.Logger
+	if l == nil {
+		l = weasel.DefaultLogger
+	}
+	l.Errorf(ctx, format, args...)
+}
+
 // redirectHandler creates a new handler which redirects all requests
-// to the specified url, preserving original path and raw query.
+// to the specified url, appending original path and raw query
+// to the url path and query.
 func redirectHandler(url string, code int) http.Handler {
-	// TODO: parse url and support path, query, etc.
+	base, query := url, ""
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		base, query = url[:i], url[i+1:]
+	}
+	base = strings.TrimSuffix(base, "/")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		u := url + r.URL.Path
+		u, q := base+r.URL.Path, query
 		if r.URL.RawQuery != "" {
-			u += "?" + r.URL.RawQuery
+			if q != "" {
+				q += "&"
+			}
+			q += r.URL.RawQuery
+		}
+		if q != "" {
+			u += "?" + q
 		}
 		http.Redirect(w, r, u, code)
 	})
 }
 
-func serveError(w http.ResponseWriter, code int, msg string) {
-	if msg == "" {
-		msg = http.StatusText(code)
+// errorTemplate is used to render error responses
+// when no error page object is configured or available.
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Code}} {{.Text}}</title></head>
+<body>
+<h1>{{.Code}} {{.Text}}</h1>
+<p>{{.Method}} {{.Host}}{{.Path}}</p>
+{{with .Trace}}<p>Trace: {{.}}</p>{{end}}
+</body>
+</html>
+`))
+
+// serveError responds to r with the code status and an error page
+// from the dir bucket directory, configured in errorPages.
+// It falls back to errorTemplate if the page object cannot be served.
+func (s *server) serveError(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, dir string, code int) {
+	if name := s.errorPage(code); name != "" {
+		name = dir + name
+		o, err := s.storage.Open(ctx, bucket, name)
+		if err == nil {
+			defer o.Body.Close()
+			s.storage.ServeError(w, r, o, code)
+			return
+		}
+		s.errorf(ctx, "error page %s/%s: %v", bucket, name, err)
 	}
+
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "no-cache")
 	w.WriteHeader(code)
-	// TODO: render some template
-	w.Write([]byte(msg))
+	if r.Method == "HEAD" {
+		return
+	}
+	errorTemplate.Execute(w, struct {
+		Code                      int
+		Text                      string
+		Method, Host, Path, Trace string
+	}{
+		Code:   code,
+		Text:   http.StatusText(code),
+		Method: r.Method,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+		Trace:  r.Header.Get("X-Cloud-Trace-Context"),
+	})
+}
+
+// errorPage returns an object name of the error page for the code,
+// matching either the exact code or its class, e.g. "4xx".
+func (s *server) errorPage(code int) string {
+	if name, ok := s.errorPages[strconv.Itoa(code)]; ok {
+		return name
+	}
+	return s.errorPages[strconv.Itoa(code/100)+"xx"]
 }
@@ -15,23 +15,27 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/google/weasel"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/memcache"
 )
 
 func TestInit(t *testing.T) {
 	Init(nil, &Config{
-		WebRoot:   "/root/",
-		HookPath:  "/flush-cache",
-		Redirects: map[string]string{"example.org/": "redir.host"},
-		TLSOnly:   []string{"tls.example.org"},
+		WebRoot:      "/root/",
+		HookPath:     "/flush-cache",
+		HookToken:    "secret",
+		PubSubPath:   "/pubsub-push",
+		PubSubEmails: []string{"push@example.com"},
+		PurgePath:    "/purge",
+		PurgeToken:   "secret",
+		Redirects:    map[string]string{"example.org/": "redir.host"},
+		TLSOnly:      []string{"tls.example.org"},
 	})
 	patterns := []struct{ in, out string }{
 		{"/", ""},
@@ -39,6 +43,8 @@ func TestInit(t *testing.T) {
 		{"/root/", "/root/"},
 		{"/root/foo", "/root/"},
 		{"/flush-cache", "/flush-cache"},
+		{"/pubsub-push", "/pubsub-push"},
+		{"/purge", "/purge"},
 		{"http://example.org/", "example.org/"},
 	}
 	for i, p := range patterns {
@@ -51,13 +57,44 @@ func TestInit(t *testing.T) {
 			t.Errorf("%d: Handler(%q) = %q; want %q", i, p.in, v, p.out)
 		}
 	}
-	r, _ := testInstance.NewRequest("GET", "http://tls.example.org/root/", nil)
+	r := httptest.NewRequest("GET", "http://tls.example.org/root/", nil)
 	r.Header.Set("X-Forwarded-Proto", "http")
 	w := httptest.NewRecorder()
 	http.DefaultServeMux.ServeHTTP(w, r)
 	if w.Code != http.StatusMovedPermanently {
 		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusMovedPermanently)
 	}
+	r = httptest.NewRequest("POST", "/purge", strings.NewReader(`{"bucket": "b", "prefixes": [""]}`))
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("purge w.Code = %d; want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// the purge endpoint isn't setup without a token
+	mux := http.NewServeMux()
+	Init(mux, &Config{PurgePath: "/purge"})
+	r = httptest.NewRequest("POST", "/purge", nil)
+	if _, v := mux.Handler(r); v != "/" {
+		t.Errorf("unauthenticated Handler(/purge) = %q; want /", v)
+	}
+}
+
+func TestInitUnauthenticated(t *testing.T) {
+	for _, conf := range []*Config{
+		{HookPath: "/flush-cache"},
+		{PubSubPath: "/pubsub-push"},
+		{PubSubPath: "/pubsub-push", PubSubAudience: "https://example.com/pubsub-push"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Init(%+v) didn't panic", conf)
+				}
+			}()
+			Init(http.NewServeMux(), conf)
+		}()
+	}
 }
 
 func TestRedirect(t *testing.T) {
@@ -68,11 +105,7 @@ func TestRedirect(t *testing.T) {
 	handler := redirectHandler(redirectTo, code)
 	urls := []string{"/", "/page", "/page/", "/page?with=query"}
 	for _, u := range urls {
-		req, err := testInstance.NewRequest("GET", u, nil)
-		if err != nil {
-			t.Errorf("%s: %v", u, err)
-			continue
-		}
+		req := httptest.NewRequest("GET", u, nil)
 		req.Host = "example.org"
 		res := httptest.NewRecorder()
 		handler.ServeHTTP(res, req)
@@ -86,6 +119,22 @@ func TestRedirect(t *testing.T) {
 	}
 }
 
+func TestRedirectPathQuery(t *testing.T) {
+	handler := redirectHandler("https://www.example.com/base/?ref=old", http.StatusFound)
+	tests := []struct{ in, out string }{
+		{"/", "https://www.example.com/base/?ref=old"},
+		{"/page", "https://www.example.com/base/page?ref=old"},
+		{"/page?q=1", "https://www.example.com/base/page?ref=old&q=1"},
+	}
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", test.in, nil))
+		if v := res.Header().Get("location"); v != test.out {
+			t.Errorf("%s: location = %q; want %q", test.in, v, test.out)
+		}
+	}
+}
+
 func TestTLSOnly(t *testing.T) {
 	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// empty 200 OK response
@@ -95,7 +144,7 @@ func TestTLSOnly(t *testing.T) {
 		storage: &weasel.Storage{Base: gcs.URL},
 		tlsOnly: map[string]struct{}{"example.com": {}},
 	}
-	r, _ := testInstance.NewRequest("GET", "http://example.com/page?foo=bar", nil)
+	r := httptest.NewRequest("GET", "http://example.com/page?foo=bar", nil)
 	r.Header.Set("X-Forwarded-Proto", "http")
 	w := httptest.NewRecorder()
 	srv.ServeHTTP(w, r)
@@ -107,7 +156,7 @@ func TestTLSOnly(t *testing.T) {
 		t.Errorf("location = %q; want %q", l, want)
 	}
 
-	r, _ = testInstance.NewRequest("GET", "https://example.com/page?foo=bar", nil)
+	r = httptest.NewRequest("GET", "https://example.com/page?foo=bar", nil)
 	r.Header.Set("X-Forwarded-Proto", "https")
 	w = httptest.NewRecorder()
 	srv.ServeHTTP(w, r)
@@ -156,14 +205,9 @@ func TestServe_DefaultGCS(t *testing.T) {
 		buckets: map[string]string{"default": bucket},
 	}
 
-	req, _ := testInstance.NewRequest("GET", reqFile, nil)
+	req := httptest.NewRequest("GET", reqFile, nil)
 	req.Header.Set("accept-encoding", "client/accept")
 	req.Header.Set("x-foo", "bar")
-	// make sure we're not getting memcached results
-	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
-		t.Fatal(err)
-	}
-
 	res := httptest.NewRecorder()
 	srv.ServeHTTP(res, req)
 	if res.Code != http.StatusOK {
@@ -209,7 +253,7 @@ func TestServe_Methods(t *testing.T) {
 		{"DELETE", "", http.StatusMethodNotAllowed},
 	}
 	for i, test := range tests {
-		r, _ := testInstance.NewRequest(test.method, "/file.txt", nil)
+		r := httptest.NewRequest(test.method, "/file.txt", nil)
 		rw := httptest.NewRecorder()
 		srv.ServeHTTP(rw, r)
 		if rw.Code != test.code {
@@ -232,10 +276,7 @@ func TestServe_GCSErrors(t *testing.T) {
 		buckets: map[string]string{"default": "bucket"},
 	}
 
-	req, err := testInstance.NewRequest("GET", "/bad", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	req := httptest.NewRequest("GET", "/bad", nil)
 	res := httptest.NewRecorder()
 	srv.ServeHTTP(res, req)
 	if res.Code != code {
@@ -263,11 +304,7 @@ func TestServe_NoTrailSlash(t *testing.T) {
 		buckets: map[string]string{"default": "bucket"},
 	}
 
-	req, _ := testInstance.NewRequest("GET", "/dir-one/two", nil)
-	// make sure we're not getting memcached results
-	if err := memcache.Flush(appengine.NewContext(req)); err != nil {
-		t.Fatal(err)
-	}
+	req := httptest.NewRequest("GET", "/dir-one/two", nil)
 	res := httptest.NewRecorder()
 	srv.ServeHTTP(res, req)
 	if res.Code != http.StatusMovedPermanently {
@@ -278,3 +315,197 @@ func TestServe_NoTrailSlash(t *testing.T) {
 		t.Errorf("location = %q; want %q", v, loc)
 	}
 }
+
+func TestServeError(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/404.html":
+			w.Header().Set("content-type", "text/html")
+			w.Write([]byte("custom not found"))
+		case "/bucket/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	srv := &server{
+		storage: &weasel.Storage{Base: gcs.URL},
+		buckets: map[string]string{"default": "bucket"},
+		errorPages: map[string]string{
+			"404": "404.html",
+			"5xx": "5xx.html", // missing
+		},
+	}
+
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{"/missing", "custom not found", http.StatusNotFound},
+		{"/broken", "<h1>500 Internal Server Error</h1>", http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d", test.path, w.Code, test.code)
+		}
+		if v := w.Body.String(); !strings.Contains(v, test.body) {
+			t.Errorf("%s: w.Body = %q; want to contain %q", test.path, v, test.body)
+		}
+		if v := w.Header().Get("content-type"); !strings.HasPrefix(v, "text/html") {
+			t.Errorf("%s: content-type = %q; want text/html", test.path, v)
+		}
+	}
+}
+
+func TestServeErrorGzip(t *testing.T) {
+	var stored bytes.Buffer
+	zw := gzip.NewWriter(&stored)
+	zw.Write([]byte("custom not found"))
+	zw.Close()
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/404.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "text/html")
+		w.Header().Set("content-encoding", "gzip")
+		w.Write(stored.Bytes())
+	}))
+	defer gcs.Close()
+	srv := &server{
+		storage:    &weasel.Storage{Base: gcs.URL},
+		buckets:    map[string]string{"default": "bucket"},
+		errorPages: map[string]string{"404": "404.html"},
+	}
+
+	// decoded for clients which don't accept gzip
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusNotFound)
+	}
+	if v := w.Body.String(); v != "custom not found" {
+		t.Errorf("w.Body = %q; want custom not found", v)
+	}
+	if v := w.Header().Get("content-encoding"); v != "" {
+		t.Errorf("content-encoding = %q; want none", v)
+	}
+
+	// served as stored otherwise
+	r = httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set("accept-encoding", "gzip")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("gzip: w.Code = %d; want %d", w.Code, http.StatusNotFound)
+	}
+	if v := w.Header().Get("content-encoding"); v != "gzip" {
+		t.Errorf("gzip: content-encoding = %q; want gzip", v)
+	}
+	if !bytes.Equal(w.Body.Bytes(), stored.Bytes()) {
+		t.Errorf("gzip: w.Body = %q; want %q", w.Body.Bytes(), stored.Bytes())
+	}
+	if v := w.Header().Get("vary"); v != "Accept-Encoding" {
+		t.Errorf("gzip: vary = %q; want Accept-Encoding", v)
+	}
+}
+
+func TestServeSPA(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/index.html":
+			w.Write([]byte("app"))
+		case "/bucket/about", "/bucket/app.js":
+			w.Write([]byte(r.URL.Path))
+		case "/bucket/docs/index.html":
+			w.Write([]byte("docs"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcs.Close()
+	srv := &server{
+		storage: &weasel.Storage{Base: gcs.URL, Index: "index.html"},
+		buckets: map[string]string{"default": "bucket"},
+		spa:     map[string]string{"app.example.com": "index.html"},
+	}
+
+	tests := []struct {
+		host, path, body string
+		code             int
+	}{
+		{"app.example.com", "/", "app", http.StatusOK},
+		{"app.example.com", "/users/123", "app", http.StatusOK},
+		{"app.example.com", "/docs", "app", http.StatusOK},
+		{"app.example.com", "/about", "/bucket/about", http.StatusOK},
+		{"app.example.com", "/app.js", "/bucket/app.js", http.StatusOK},
+		{"app.example.com", "/missing.css", "", http.StatusNotFound},
+		{"App.Example.com:8080", "/users/123", "app", http.StatusOK},
+		{"www.example.com", "/users/123", "", http.StatusNotFound},
+		{"www.example.com", "/docs", "", http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s%s: w.Code = %d; want %d", test.host, test.path, w.Code, test.code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s%s: w.Body = %q; want %q", test.host, test.path, w.Body.String(), test.body)
+		}
+	}
+}
+
+func TestServeAutoIndex(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v := r.FormValue("prefix"); v != "downloads/" {
+			t.Errorf("prefix = %q; want downloads/", v)
+		}
+		if v := r.FormValue("delimiter"); v != "/" {
+			t.Errorf("delimiter = %q; want /", v)
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{
+			"items": [{"name": "downloads/app.tgz", "size": "42"}],
+			"prefixes": ["downloads/v1/"]
+		}`))
+	}))
+	defer gcs.Close()
+	srv := &server{
+		storage:   &weasel.Storage{Base: gcs.URL, Index: "index.html"},
+		buckets:   map[string]string{"default": "bucket"},
+		autoIndex: map[string]struct{}{"example.com": {}},
+	}
+
+	for _, host := range []string{"example.com", "Example.com:8080"} {
+		r := httptest.NewRequest("GET", "http://"+host+"/downloads/?format=json", nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: w.Code = %d; want 200", host, w.Code)
+		}
+		body := w.Body.String()
+		for _, s := range []string{`"name":"app.tgz"`, `"size":42`, `"name":"v1/"`} {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: body = %s; want to contain %s", host, body, s)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://other.example.com/downloads/", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("other host: w.Code = %d; want 404", w.Code)
+	}
+}
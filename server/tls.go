@@ -0,0 +1,191 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sources of the request scheme, see Config.TLSSource.
+const (
+	sourceXForwardedProto = "x-forwarded-proto"
+	sourceForwarded       = "forwarded"
+	sourceTLS             = "tls"
+)
+
+// defaultHSTSMaxAge is max-age of HSTS policies without an explicit one.
+const defaultHSTSMaxAge = 10886400 // 126 days
+
+// HSTS is a Strict-Transport-Security policy of TLSOnly hosts.
+type HSTS struct {
+	// MaxAge is the policy lifetime in seconds.
+	// Zero means 126 days, while a negative value results in max-age=0,
+	// which makes browsers forget the policy.
+	MaxAge int
+
+	// IncludeSubDomains applies the policy to all subdomains of the host.
+	IncludeSubDomains bool
+
+	// Preload consents to inclusion of the host in browser preload lists.
+	Preload bool
+}
+
+// value returns the Strict-Transport-Security header value of the policy.
+func (h *HSTS) value() string {
+	age := h.MaxAge
+	switch {
+	case age == 0:
+		age = defaultHSTSMaxAge
+	case age < 0:
+		age = 0
+	}
+	v := "max-age=" + strconv.Itoa(age)
+	if h.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// tlsSource normalizes Config.TLSSource.
+// It returns an error if the source is unknown.
+func tlsSource(src string) (string, error) {
+	switch s := strings.ToLower(src); s {
+	case "", sourceXForwardedProto:
+		return sourceXForwardedProto, nil
+	case sourceForwarded, sourceTLS:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown TLS source %q", src)
+}
+
+// scheme returns the scheme of request r, "http" or "https", as reported
+// by the configured source, or an empty string if it is unknown.
+func (s *server) scheme(r *http.Request) string {
+	var proto string
+	switch s.tlsSource {
+	case sourceTLS:
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	case sourceForwarded:
+		proto = forwardedProto(r.Header)
+	default:
+		// the last value is added by the nearest proxy,
+		// while earlier ones could have been forged by the client
+		if vv := r.Header["X-Forwarded-Proto"]; len(vv) > 0 {
+			proto = vv[len(vv)-1]
+			proto = proto[strings.LastIndexByte(proto, ',')+1:]
+		}
+	}
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto
+	}
+	return ""
+}
+
+// forwardedProto returns the proto parameter of the last Forwarded header
+// element, which is the one added by the nearest proxy.
+// Elements added earlier could have been forged by the client.
+func forwardedProto(h http.Header) string {
+	vv := h["Forwarded"]
+	if len(vv) == 0 {
+		return ""
+	}
+	elems := strings.Split(vv[len(vv)-1], ",")
+	for _, pair := range strings.Split(elems[len(elems)-1], ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// forceTLS reports whether the host is one of TLSOnly hosts.
+func (s *server) forceTLS(host string) bool {
+	if len(s.tlsOnly) == 0 {
+		return false
+	}
+	if _, ok := s.tlsOnly[host]; ok {
+		return true
+	}
+	host = hostname(host)
+	if _, ok := s.tlsOnly[host]; ok {
+		return true
+	}
+	for k := range s.tlsOnly {
+		if matchWildcard(k, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// stsHeader returns the Strict-Transport-Security header value of the host:
+// the policy of the host name, of the longest matching wildcard,
+// of the "default" key, or stsValue if none is configured.
+func (s *server) stsHeader(host string) string {
+	host = hostname(host)
+	if h, ok := s.hsts[host]; ok {
+		return h.value()
+	}
+	best := ""
+	for k := range s.hsts {
+		if len(k) > len(best) && matchWildcard(k, host) {
+			best = k
+		}
+	}
+	if best == "" {
+		best = "default"
+	}
+	if h, ok := s.hsts[best]; ok {
+		return h.value()
+	}
+	return stsValue
+}
+
+// matchWildcard reports whether pattern "*" or "*.example.com" matches
+// the host. The latter matches subdomains but not example.com itself.
+func matchWildcard(pattern, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return false
+}
+
+// redirectTLS redirects request r to the https scheme, with 301 status
+// for GET and HEAD requests and 308 for others, preserving the method.
+func redirectTLS(w http.ResponseWriter, r *http.Request) {
+	u := "https://" + r.Host + r.URL.Path
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u, code)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/weasel"
+)
+
+func TestTLSPolicies(t *testing.T) {
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// empty 200 OK response
+	}))
+	defer gcs.Close()
+	srv := &server{
+		storage: &weasel.Storage{Base: gcs.URL},
+		tlsOnly: map[string]struct{}{"*.example.com": {}, "example.org": {}},
+		hsts: map[string]*HSTS{
+			"*.example.com":     {MaxAge: 60},
+			"*.app.example.com": {MaxAge: 120, IncludeSubDomains: true},
+			"www.example.com":   {Preload: true},
+			"default":           {MaxAge: -1},
+		},
+	}
+	tests := []struct {
+		method, url, proto string
+		code               int
+		location, sts      string
+	}{
+		{"GET", "http://www.example.com/a?b=c", "http", http.StatusMovedPermanently, "https://www.example.com/a?b=c", ""},
+		{"HEAD", "http://x.example.com/", "http", http.StatusMovedPermanently, "https://x.example.com/", ""},
+		{"OPTIONS", "http://x.example.com/", "http", http.StatusPermanentRedirect, "https://x.example.com/", ""},
+		{"POST", "http://x.example.com/", "http", http.StatusPermanentRedirect, "https://x.example.com/", ""},
+		{"POST", "https://x.example.com/", "https", http.StatusMethodNotAllowed, "", "max-age=60"},
+		{"GET", "https://www.example.com/", "https", http.StatusOK, "", "max-age=10886400; preload"},
+		{"GET", "https://a.b.app.example.com/", "https", http.StatusOK, "", "max-age=120; includeSubDomains"},
+		{"GET", "https://example.org:443/", "https", http.StatusOK, "", "max-age=0"},
+		{"GET", "http://example.com/", "http", http.StatusOK, "", ""},
+		{"GET", "http://x.example.com/", "", http.StatusOK, "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if test.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: w.Code = %d; want %d", test.method, test.url, w.Code, test.code)
+		}
+		if v := w.Header().Get("location"); v != test.location {
+			t.Errorf("%s %s: location = %q; want %q", test.method, test.url, v, test.location)
+		}
+		if v := w.Header().Get("strict-transport-security"); v != test.sts {
+			t.Errorf("%s %s: strict-transport-security = %q; want %q", test.method, test.url, v, test.sts)
+		}
+	}
+}
+
+func TestTLSSource(t *testing.T) {
+	tests := []struct {
+		source string
+		header map[string][]string
+		tls    bool
+		scheme string
+	}{
+		{"", map[string][]string{"X-Forwarded-Proto": {"HTTPS"}}, false, "https"},
+		{"", map[string][]string{"X-Forwarded-Proto": {"http, https"}}, false, "https"},
+		{"", map[string][]string{"X-Forwarded-Proto": {"https, http"}}, false, "http"},
+		{"", map[string][]string{"X-Forwarded-Proto": {"https", "http"}}, false, "http"},
+		{"", map[string][]string{"Forwarded": {"proto=https"}}, true, ""},
+		{"forwarded", map[string][]string{"Forwarded": {"for=1.2.3.4;Proto=HTTPS"}}, false, "https"},
+		{"forwarded", map[string][]string{"Forwarded": {`proto=https, for="[::1]";proto="http"`}}, false, "http"},
+		{"forwarded", map[string][]string{"Forwarded": {"proto=http", "for=1.2.3.4;proto=https"}}, false, "https"},
+		{"forwarded", map[string][]string{"Forwarded": {"for=1.2.3.4"}}, false, ""},
+		{"forwarded", map[string][]string{"X-Forwarded-Proto": {"https"}}, false, ""},
+		{"TLS", map[string][]string{"X-Forwarded-Proto": {"https"}}, false, "http"},
+		{"tls", nil, true, "https"},
+	}
+	for i, test := range tests {
+		src, err := tlsSource(test.source)
+		if err != nil {
+			t.Errorf("%d: tlsSource(%q): %v", i, test.source, err)
+			continue
+		}
+		srv := &server{tlsSource: src}
+		u := "http://example.com/"
+		if test.tls {
+			u = "https://example.com/"
+		}
+		r := httptest.NewRequest("GET", u, nil)
+		r.Header = test.header
+		if v := srv.scheme(r); v != test.scheme {
+			t.Errorf("%d: scheme = %q; want %q", i, v, test.scheme)
+		}
+	}
+	if _, err := tlsSource("X-Real-Proto"); err == nil {
+		t.Error("tlsSource(X-Real-Proto): no error")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// refreshTimeout limits duration of a background refresh.
+	refreshTimeout = 30 * time.Second
+	// fillTimeout limits duration of caching a large object in background.
+	fillTimeout = 5 * time.Minute
+)
+
+// staleWhileRevalidate returns how long an object with the meta headers
+// may be served stale while it is refreshed in background, as per RFC 5861.
+func (s *Storage) staleWhileRevalidate(meta map[string]string) time.Duration {
+	return s.staleDirective(meta, "stale-while-revalidate", s.StaleWhileRevalidate)
+}
+
+// staleIfError returns how long an object with the meta headers
+// may be served stale when the backend fails, as per RFC 5861.
+func (s *Storage) staleIfError(meta map[string]string) time.Duration {
+	return s.staleDirective(meta, "stale-if-error", s.StaleIfError)
+}
+
+// staleDirective returns cache-control directive d of the meta headers
+// in seconds, or def if the directive is missing or invalid.
+func (s *Storage) staleDirective(meta map[string]string, d string, def time.Duration) time.Duration {
+	cc := parseCacheControl(meta["cache-control"])
+	if v, ok := parseSeconds(cc[d]); ok {
+		return v
+	}
+	return def
+}
+
+// staleUsable reports whether stale cache entry b is within the stale window
+// of the given duration since it has expired.
+func staleUsable(b *objectBuf, window time.Duration) bool {
+	return window > 0 && !b.Expires.IsZero() && time.Since(b.Expires) < window
+}
+
+// staleOnError reports whether err is a backend failure
+// which stale-if-error applies to.
+func staleOnError(err error) bool {
+	if ferr, ok := err.(*FetchError); ok {
+		return ferr.Code >= 500
+	}
+	return err != context.Canceled
+}
+
+// refresh fetches object name of the bucket in background, updating
+// its stale cache entry b. It does nothing if a fetch is already in progress.
+func (s *Storage) refresh(ctx context.Context, key, bucket, name string, b *objectBuf) {
+	flights.Lock()
+	_, busy := flights.m[key]
+	flights.Unlock()
+	if busy {
+		return
+	}
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, refreshTimeout)
+	defer cancel()
+	o, err := s.coalesce(ctx, key, bucket, name, func() (*Object, *objectBuf, error) {
+		return s.fetch(ctx, key, bucket, name, b)
+	})
+	if err != nil {
+		s.errorf(ctx, "refresh %s/%s: %v", bucket, name, err)
+		return
+	}
+	// streamed bodies are cached only when read in full
+	io.Copy(ioutil.Discard, o.Body)
+	o.Body.Close()
+}
+
+// detachedContext carries values of its parent context,
+// but not its deadline and cancelation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// backendContext returns a context for retrieving an object from the backend
+// within ctx. It is canceled along with ctx until detach is called,
+// which lets the object body outlive ctx for at most timeout,
+// e.g. to be cached in background. The cancel func releases
+// the context resources, and must be called when the body is closed.
+func backendContext(ctx context.Context) (bctx context.Context, detach func(timeout time.Duration), cancel func()) {
+	bctx, cancel = context.WithCancel(detachedContext{ctx})
+	detached := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-bctx.Done():
+		case <-detached:
+		}
+	}()
+	detach = func(timeout time.Duration) {
+		close(detached)
+		time.AfterFunc(timeout, cancel)
+	}
+	return bctx, detach, cancel
+}
+
+// cancelBody is an Object.Body which releases its context when closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
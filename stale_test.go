@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package weasel
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// expireCache makes cached object key of stor expired for the given duration.
+func expireCache(t *testing.T, stor *Storage, key string, ago time.Duration) {
+	ctx := context.Background()
+	b, err := stor.getCache(ctx, key)
+	if err != nil {
+		t.Fatalf("stor.getCache(%q): %v", key, err)
+	}
+	b.Expires = time.Now().Add(-ago)
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(b)
+	stor.Cache.Set(ctx, key, buf.Bytes(), time.Hour)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var version int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("cache-control", "max-age=60, stale-while-revalidate=120")
+		fmt.Fprintf(w, "v%d", atomic.AddInt32(&version, 1))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
+	read := func() string {
+		o, err := stor.Open(ctx, "bucket", "file.txt")
+		if err != nil {
+			t.Fatalf("stor.Open: %v", err)
+		}
+		defer o.Body.Close()
+		b, _ := ioutil.ReadAll(o.Body)
+		return string(b)
+	}
+	if v := read(); v != "v1" {
+		t.Fatalf("read() = %q; want v1", v)
+	}
+
+	key := stor.objectKey(ctx, "bucket", "file.txt")
+	expireCache(t, stor, key, time.Second)
+	if v := read(); v != "v1" {
+		t.Errorf("stale read() = %q; want v1", v)
+	}
+	// wait for the background refresh
+	for i := 0; i < 100; i++ {
+		if b, err := stor.getCache(ctx, key); err == nil && b.fresh() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := read(); v != "v2" {
+		t.Errorf("refreshed read() = %q; want v2", v)
+	}
+
+	// too old to be served stale
+	expireCache(t, stor, key, 3*time.Minute)
+	if v := read(); v != "v3" {
+		t.Errorf("read() = %q; want v3", v)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("cache-control", "max-age=60")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	stor := &Storage{
+		Base:         ts.URL,
+		Cache:        NewLRU(1 << 20),
+		StaleIfError: time.Minute,
+	}
+	o, err := stor.Open(ctx, "bucket", "file.txt")
+	if err != nil {
+		t.Fatalf("stor.Open: %v", err)
+	}
+	o.Body.Close()
+
+	atomic.StoreInt32(&fail, 1)
+	key := stor.objectKey(ctx, "bucket", "file.txt")
+	expireCache(t, stor, key, time.Second)
+	o, err = stor.Open(ctx, "bucket", "file.txt")
+	if err != nil {
+		t.Fatalf("stale stor.Open: %v", err)
+	}
+	b, _ := ioutil.ReadAll(o.Body)
+	o.Body.Close()
+	if string(b) != "contents" {
+		t.Errorf("stale body = %q; want contents", b)
+	}
+
+	expireCache(t, stor, key, 2*time.Minute)
+	_, err = stor.Open(ctx, "bucket", "file.txt")
+	if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusServiceUnavailable {
+		t.Errorf("stor.Open: %v; want 503 FetchError", err)
+	}
+}
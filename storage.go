@@ -22,6 +22,7 @@ package weasel
 import (
 	"bytes"
 	"context"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -29,18 +30,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/google/weasel/internal"
-
-	"golang.org/x/oauth2"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
-	"google.golang.org/appengine/urlfetch"
 )
 
-// Google Cloud Storage OAuth2 scopes.
-const scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
-
 // DefaultStorage is a Storage with sensible default parameters.
 var DefaultStorage = &Storage{
 	Base:  "https://storage.googleapis.com",
@@ -62,9 +53,76 @@ type Storage struct {
 	Base  string // GCS service base URL, e.g. "https://storage.googleapis.com".
 	Index string // Appended to an object name in certain cases, e.g. "index.html".
 	CORS  CORS
+
+	// Backend retrieves objects on cache misses.
+	// If nil, GCS at Base is used.
+	Backend Backend
+
+	// Cache stores retrieved objects.
+	// If nil, App Engine memcache is used when running on App Engine
+	// standard, and an in-process cache otherwise.
+	Cache Cache
+
+	// Logger reports errors which cannot be returned to a caller.
+	// If nil, DefaultLogger is used.
+	Logger Logger
+
+	// MinCacheTTL and MaxCacheTTL bound cache expiration of objects,
+	// which is derived from their cache-control s-maxage or max-age.
+	// Objects without either directive are cached for MaxCacheTTL,
+	// while objects with no-cache or a zero max-age are not cached.
+	// Zero MaxCacheTTL means 24 hours.
+	MinCacheTTL time.Duration
+	MaxCacheTTL time.Duration
+
+	// StaleTTL is how long expired objects are kept in cache
+	// for revalidation with the backend.
+	// Zero means 24 hours, while negative values disable revalidation.
+	StaleTTL time.Duration
+
+	// StaleWhileRevalidate and StaleIfError are defaults for objects
+	// without stale-while-revalidate and stale-if-error cache-control
+	// directives, as described in RFC 5861.
+	// Zero values disable serving stale objects.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// MaxCacheSize limits size of large objects, which are cached
+	// in chunks. Zero means 16MB, while negative values disable
+	// caching of objects larger than a single cache item.
+	MaxCacheSize int64
+
+	// DisableCompression turns off serving of precompressed objects,
+	// such as "app.js.br" for "app.js", and compression on the fly.
+	// Objects stored with a content coding are still decoded for clients
+	// which don't accept it.
+	DisableCompression bool
+
+	// Headers are additional object headers served with objects retrieved
+	// from GCS, such as "content-language", besides the standard ones like
+	// content-type and cache-control.
+	// Object custom metadata "x-goog-meta-header-NAME" is always served
+	// as NAME response header, e.g. "x-goog-meta-header-x-frame-options",
+	// except for headers set by Storage itself, such as allow and CORS ones.
+	// A custom vary is served in addition to the content coding one.
+	Headers []string
+
+	// PushManifest is an optional object name of a bucket push manifest,
+	// e.g. "push_manifest.json", listing assets to preload for each page
+	// in addition to the page object "x-goog-meta-preload" metadata.
+	PushManifest string
+
+	// PushCookie is a name of the cookie used to remember preloaded assets
+	// during a browser session, so that they are not pushed again.
+	// Responses with preloads then vary by cookie, which usually makes
+	// them uncacheable by CDNs and other shared caches.
+	// If empty, assets are preloaded on every request.
+	PushCookie string
 }
 
 // OpenFile abstracts Open and treats object name like a file path.
+// Names of directories with an index object are redirected to the directory
+// path ending with "/". Such redirects are cached along with the object.
 func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, error) {
 	if name == "" || strings.HasSuffix(name, "/") {
 		name += s.Index
@@ -72,6 +130,13 @@ func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, e
 
 	// stat /dir/index.html if name is /dir, concurrently
 	checkStat := !strings.HasSuffix(name, s.Index) && filepath.Ext(name) == ""
+	var dirKey string
+	if checkStat {
+		dirKey = s.dirKey(ctx, bucket, name)
+		if b, err := s.getCache(ctx, dirKey); err == nil && b.fresh() {
+			return b.object(bucket, name), nil
+		}
+	}
 	type stat struct {
 		o   *Object
 		err error
@@ -102,7 +167,7 @@ func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, e
 	// TODO: use ctxhttp
 	select {
 	case <-time.After(5 * time.Second):
-		log.Errorf(ctx, "s.Stat(bucket=%q) timeout", bucket)
+		s.errorf(ctx, "s.Stat(bucket=%q) timeout", bucket)
 		// return original Open error
 		return nil, err
 	case res := <-ch:
@@ -113,157 +178,345 @@ func (s *Storage) OpenFile(ctx context.Context, bucket, name string) (*Object, e
 		o = res.o
 	}
 	if o.Redirect() == "" {
+		b := &objectBuf{Meta: map[string]string{
+			metaRedirect: path.Join("/", name) + "/",
+		}}
+		if ttl := s.cacheTTL(o.Meta); ttl > 0 {
+			s.setCache(ctx, dirKey, b, ttl)
+		}
 		o = &Object{
 			Body: ioutil.NopCloser(bytes.NewReader(nil)),
-			Meta: map[string]string{
-				metaRedirect: path.Join("/", name) + "/",
-			},
+			Meta: b.Meta,
 		}
 	}
 	return o, nil
 }
 
-// Open retrieves GCS object name of the bucket from cache or network.
-// Objects fetched from the network are cached before returning
+// Open retrieves object name of the bucket from cache or s.Backend.
+// Objects retrieved from the backend are cached before returning
 // from this function.
+//
+// Expired cached objects with an etag are revalidated with the backend,
+// and served from cache if they haven't changed.
+// Expired objects are also served from cache while they are refreshed
+// in background, or when the backend fails, for as long as allowed by
+// their stale-while-revalidate and stale-if-error cache-control directives.
+//
+// Objects with a rewrite, and without a redirect, are followed to
+// the object named by their rewrite, which is returned instead.
 func (s *Storage) Open(ctx context.Context, bucket, name string) (*Object, error) {
-	key := s.CacheKey(bucket, name)
-	o, err := getCache(ctx, key)
-	if err != nil {
-		u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
-		o, err = fetch(ctx, u, key)
+	o, err := s.open(ctx, bucket, name)
+	for i := 0; err == nil && o.Rewrite() != "" && o.Redirect() == ""; i++ {
+		o.Body.Close()
+		if i == maxRewrites {
+			return nil, &FetchError{Msg: "too many rewrites", Code: http.StatusLoopDetected}
+		}
+		name = s.rewriteName(name, o.Rewrite())
+		o, err = s.open(ctx, bucket, name)
 	}
 	return o, err
 }
 
-// Stat is similar to Read except the returned Object.Body may be nil.
-// In the case where Body is not nil, calling Body.Close() is not required.
-func (s *Storage) Stat(ctx context.Context, bucket, name string) (*Object, error) {
-	if o, err := getCache(ctx, s.CacheKey(bucket, name)); err == nil {
-		return o, nil
+// rewriteName returns the name object name is rewritten to by rewrite to.
+// Names ending with "/" are appended with s.Index.
+func (s *Storage) rewriteName(name, to string) string {
+	isDir := strings.HasSuffix(to, "/")
+	if !strings.HasPrefix(to, "/") {
+		to = path.Join(path.Dir(name), to)
+	}
+	to = strings.TrimPrefix(path.Join("/", to), "/")
+	if isDir || to == "" {
+		to = path.Join(to, s.Index)
+	}
+	return to
+}
+
+// open retrieves object name of the bucket from cache or s.Backend,
+// as described in Open, without following rewrites.
+func (s *Storage) open(ctx context.Context, bucket, name string) (*Object, error) {
+	key := s.objectKey(ctx, bucket, name)
+	b, err := s.getCache(ctx, key)
+	if err == nil && b.fresh() {
+		return b.object(bucket, name), nil
 	}
-	u := fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
-	req, err := http.NewRequest("HEAD", u, nil)
 	if err != nil {
-		return nil, err
+		b = nil
+	}
+	if b != nil && staleUsable(b, s.staleWhileRevalidate(b.Meta)) {
+		go s.refresh(ctx, key, bucket, name, b)
+		return b.object(bucket, name), nil
+	}
+	o, err := s.coalesce(ctx, key, bucket, name, func() (*Object, *objectBuf, error) {
+		return s.fetch(ctx, key, bucket, name, b)
+	})
+	if err != nil && b != nil && staleOnError(err) && staleUsable(b, s.staleIfError(b.Meta)) {
+		s.errorf(ctx, "%s/%s: serving stale: %v", bucket, name, err)
+		return b.object(bucket, name), nil
+	}
+	return o, err
+}
+
+// fetch retrieves object name of the bucket from s.Backend,
+// revalidating stale cache entry b if it is not nil.
+// The returned objectBuf is the object cached in full, or a manifest
+// of a large object being cached in chunks, which can be shared with
+// concurrent callers. It is nil if the object body is streamed.
+func (s *Storage) fetch(ctx context.Context, key, bucket, name string, b *objectBuf) (*Object, *objectBuf, error) {
+	var opts *OpenOptions
+	if b != nil && b.Meta["etag"] != "" {
+		opts = &OpenOptions{IfNoneMatch: b.Meta["etag"]}
 	}
-	res, err := httpClient(ctx, scopeStorageRead).Do(req)
+	bctx, detach, cancel := backendContext(ctx)
+	o, err := s.backend().Open(bctx, bucket, name, opts)
 	if err != nil {
-		return nil, err
+		cancel()
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		b, _ := ioutil.ReadAll(res.Body)
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
+	if ferr, ok := err.(*FetchError); ok && ferr.Code == http.StatusNotModified {
+		if ttl := s.cacheTTL(b.Meta); ttl > 0 {
+			s.setCache(ctx, key, b, ttl)
 		}
+		return b.object(bucket, name), b, nil
 	}
-	meta := make(map[string]string)
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			meta[k] = v
+	if err != nil {
+		return nil, nil, err
+	}
+	o.bucket, o.name = bucket, name
+	o.Body = cancelBody{o.Body, cancel}
+	// auto-cache the body if it is within allowed cache limits
+	ttl := s.cacheTTL(o.Meta)
+	max := s.maxCacheSize()
+	switch {
+	case ttl <= 0:
+		// not cacheable
+	case max > 0 && o.Size >= cacheItemMax && o.Size < max:
+		// large; cached in background and shared with concurrent callers
+		detach(fillTimeout)
+		o, b = s.fillChunks(ctx, bctx, key, o, ttl)
+		return o, b, nil
+	case max > 0 && o.Size < 0:
+		// unknown size, checked while reading
+		o.Body = &chunkBuf{objectBuf{
+			Meta: o.Meta,
+			r:    o.Body,
+			key:  key,
+			ttl:  ttl,
+			ctx:  ctx,
+			stor: s,
+		}}
+	case o.Size >= 0 && o.Size < cacheItemMax:
+		// small enough to be read in full and shared
+		buf := &objectBuf{
+			Meta: o.Meta,
+			r:    o.Body,
+			key:  key,
+			ttl:  ttl,
+			ctx:  ctx,
+			stor: s,
+		}
+		body, err := ioutil.ReadAll(buf)
+		o.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		b = &objectBuf{Meta: o.Meta, Body: body}
+		return b.object(bucket, name), b, nil
+	case o.Size < cacheItemMax:
+		o.Body = &objectBuf{
+			Meta: o.Meta,
+			r:    o.Body,
+			key:  key,
+			ttl:  ttl,
+			ctx:  ctx,
+			stor: s,
 		}
 	}
-	return &Object{Meta: meta}, nil
+	return o, nil, nil
 }
 
-// PurgeCache removes cached object from memcache.
+// Stat is similar to Read except the returned Object.Body may be nil.
+// In the case where Body is not nil, calling Body.Close() is not required.
+func (s *Storage) Stat(ctx context.Context, bucket, name string) (*Object, error) {
+	if b, err := s.getCache(ctx, s.objectKey(ctx, bucket, name)); err == nil && b.fresh() {
+		return b.object(bucket, name), nil
+	}
+	return s.backend().Stat(ctx, bucket, name)
+}
+
+// PurgeCache removes cached object from s.Cache, along with entries derived
+// from it, such as its compressed variants, the parent directory listing
+// and redirects to the directory of an index object.
 // It does not return an error in the case of cache miss.
 func (s *Storage) PurgeCache(ctx context.Context, bucket, name string) error {
-	return purgeCache(ctx, s.CacheKey(bucket, name))
+	if s.PushManifest != "" && name == s.PushManifest {
+		s.forgetManifest(bucket)
+	}
+	for _, k := range s.cacheKeys(ctx, bucket, name) {
+		if err := s.cache().Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheKeys returns cache keys of object name of the bucket,
+// including keys of entries derived from the object.
+// Chunks of large objects are not included as they are unreachable
+// without the object manifest entry.
+func (s *Storage) cacheKeys(ctx context.Context, bucket, name string) []string {
+	key := s.objectKey(ctx, bucket, name)
+	keys := []string{key, key + "#missing"}
+	for _, e := range encodings {
+		keys = append(keys, key+"#"+e.name)
+	}
+	// OpenFile redirects of the name or the index object directory
+	switch {
+	case s.Index != "" && path.Base(name) == s.Index && name != s.Index:
+		keys = append(keys, s.dirKey(ctx, bucket, strings.TrimSuffix(name, "/"+s.Index)))
+	case filepath.Ext(name) == "" && !strings.HasSuffix(name, "/"):
+		keys = append(keys, s.dirKey(ctx, bucket, name))
+	}
+	return append(keys, s.listKeys(ctx, bucket, parentDir(name))...)
+}
+
+// dirKey returns a cache key of OpenFile redirect of name to the directory.
+// It is derived from the directory, so that PurgePrefix removes it as well.
+func (s *Storage) dirKey(ctx context.Context, bucket, name string) string {
+	return s.objectKey(ctx, bucket, name+"/") + "#dir"
 }
 
-// CacheKey returns a key to cache an object under, computed from
+// CacheKey returns a base of cache keys of an object, computed from
 // s.Base, bucket and then name.
+// Actual keys also depend on generation numbers, see PurgePrefix.
 func (s *Storage) CacheKey(bucket, name string) string {
 	return fmt.Sprintf("%s/%s", s.Base, path.Join(bucket, name))
 }
 
-// fetch retrieves object from the given url.
-// The returned error will be of type FetchError if the storage responds
-// with an error code.
-//
-// The returned Object.Body will auto-cache in memcache if cacheKey
-// is provided and body length is within allowed cache limits.
-func fetch(ctx context.Context, url, cacheKey string) (*Object, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// backend returns s.Backend or GCS at s.Base if the former is nil.
+func (s *Storage) backend() Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+	return &GCS{Base: s.Base, Headers: s.Headers}
+}
+
+// cache returns s.Cache or the platform default if the former is nil.
+func (s *Storage) cache() Cache {
+	if s.Cache != nil {
+		return s.Cache
+	}
+	return defaultCache
+}
+
+// errorf reports an error using s.Logger or DefaultLogger if the former is nil.
+func (s *Storage) errorf(ctx context.Context, format string, args ...interface{}) {
+	l := s.Logger
+	if l == nil {
+		l = DefaultLogger
+	}
+	l.Errorf(ctx, format, args...)
+}
+
+// getCache retrieves an object stored with setCache.
+// The returned object may be stale.
+func (s *Storage) getCache(ctx context.Context, key string) (*objectBuf, error) {
+	v, err := s.cache().Get(ctx, key)
 	if err != nil {
+		if err != ErrCacheMiss {
+			s.errorf(ctx, "cache.Get(%q): %v", key, err)
+		}
 		return nil, err
 	}
-	res, err := httpClient(ctx, scopeStorageRead).Do(req)
-	if err != nil {
+	b := &objectBuf{key: key, ctx: ctx, stor: s}
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(b); err != nil {
+		s.errorf(ctx, "gob.Decode(%q): %v", key, err)
 		return nil, err
 	}
-	if res.StatusCode > 399 {
-		// FetchError takes precedence over i/o errors
-		b, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		return nil, &FetchError{
-			Msg:  fmt.Sprintf("%s: %s", res.Status, b),
-			Code: res.StatusCode,
-		}
+	return b, nil
+}
+
+// cacheTTL returns cache expiration of an object with the meta headers.
+// It is based on cache-control s-maxage or max-age, bounded by
+// s.MinCacheTTL and s.MaxCacheTTL. Objects with no-cache or a zero
+// max-age are not cached regardless of s.MinCacheTTL.
+// Zero result means the object must not be cached.
+func (s *Storage) cacheTTL(meta map[string]string) time.Duration {
+	max := s.MaxCacheTTL
+	if max == 0 {
+		max = defaultCacheTTL
 	}
-	m := make(map[string]string)
-	for _, k := range objectHeaders {
-		if v := res.Header.Get(k); v != "" {
-			m[k] = v
-		}
+	cc := parseCacheControl(meta["cache-control"])
+	if _, ok := cc["no-store"]; ok {
+		return 0
 	}
-	rc := res.Body
-	if cacheKey != "" && res.ContentLength < cacheItemMax {
-		rc = &objectBuf{
-			Meta: m,
-			r:    res.Body,
-			key:  cacheKey,
-			ctx:  ctx,
-		}
+	if _, ok := cc["private"]; ok {
+		return 0
 	}
-	o := &Object{
-		Meta: m,
-		Body: rc,
+	ttl, ok := parseSeconds(cc["s-maxage"])
+	if !ok {
+		ttl, ok = parseSeconds(cc["max-age"])
 	}
-	return o, nil
-}
-
-func getCache(ctx context.Context, key string) (*Object, error) {
-	var b objectBuf
-	if _, err := memcache.Gob.Get(ctx, key, &b); err != nil {
-		if err != memcache.ErrCacheMiss {
-			log.Errorf(ctx, "memcache.Gob.Get(%q): %v", key, err)
-		}
-		return nil, err
+	if _, noCache := cc["no-cache"]; noCache || ok && ttl == 0 {
+		// must be revalidated on every request
+		return 0
 	}
-	o := &Object{
-		Meta: b.Meta,
-		Body: ioutil.NopCloser(bytes.NewReader(b.Body)),
+	if !ok || ttl > max {
+		ttl = max
 	}
-	return o, nil
+	if ttl < s.MinCacheTTL {
+		ttl = s.MinCacheTTL
+	}
+	return ttl
 }
 
-func purgeCache(ctx context.Context, key string) error {
-	err := memcache.Delete(ctx, key)
-	if err == memcache.ErrCacheMiss {
-		err = nil
+// setCache stores exported fields of b in s.Cache, fresh for ttl.
+// Objects with an etag are kept in cache for additional s.StaleTTL
+// after they expire, so that they can be revalidated with the backend.
+func (s *Storage) setCache(ctx context.Context, key string, b *objectBuf, ttl time.Duration) {
+	b.Expires = time.Now().Add(ttl)
+	ttl = s.entryTTL(b.Meta, ttl)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		s.errorf(ctx, "gob.Encode(%q): %v", key, err)
+		return
+	}
+	if err := s.cache().Set(ctx, key, buf.Bytes(), ttl); err != nil {
+		s.errorf(ctx, "cache.Set(%q): %v", key, err)
 	}
-	return err
 }
 
-func httpClient(ctx context.Context, scopes ...string) *http.Client {
-	t := &oauth2.Transport{
-		Source: internal.AETokenSource(ctx, scopes...),
-		Base:   &urlfetch.Transport{Context: ctx},
+// entryTTL returns how long a cache entry of an object with the meta headers
+// and ttl cache expiration is kept in cache, including time for revalidation.
+func (s *Storage) entryTTL(meta map[string]string, ttl time.Duration) time.Duration {
+	var stale time.Duration
+	if meta["etag"] != "" {
+		stale = s.staleTTL()
+	}
+	for _, d := range []time.Duration{s.staleWhileRevalidate(meta), s.staleIfError(meta)} {
+		if d > stale {
+			stale = d
+		}
 	}
-	return &http.Client{Transport: t}
+	return ttl + stale
 }
 
-// FetchError contains error code and message from a GCS response.
-type FetchError struct {
-	Msg  string
-	Code int
+// maxCacheSize returns s.MaxCacheSize or its default value if the former is zero.
+func (s *Storage) maxCacheSize() int64 {
+	switch {
+	case s.MaxCacheSize < 0:
+		return 0
+	case s.MaxCacheSize == 0:
+		return defaultMaxCacheSize
+	}
+	return s.MaxCacheSize
 }
 
-// Error returns formatted FetchError.
-func (e *FetchError) Error() string {
-	return fmt.Sprintf("FetchError %d: %s", e.Code, e.Msg)
+// staleTTL returns s.StaleTTL or its default value if the former is zero.
+func (s *Storage) staleTTL() time.Duration {
+	switch {
+	case s.StaleTTL < 0:
+		return 0
+	case s.StaleTTL == 0:
+		return defaultStaleTTL
+	}
+	return s.StaleTTL
 }
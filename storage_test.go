@@ -15,15 +15,16 @@
 package weasel
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/memcache"
+	"time"
 )
 
 func TestOpenFileIndex(t *testing.T) {
@@ -45,14 +46,8 @@ func TestOpenFileIndex(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	req, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(req)
-	// make sure we're not getting memcached results
-	if err := memcache.Flush(ctx); err != nil {
-		t.Fatal(err)
-	}
-
-	stor := &Storage{Base: ts.URL, Index: "index"}
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Index: "index", Cache: NewLRU(1 << 20)}
 	obj, err := stor.OpenFile(ctx, "bucket", "/dir/")
 	if err != nil {
 		t.Fatalf("stor.OpenFile: %v", err)
@@ -85,14 +80,8 @@ func testOpenFileNoTrailSlash(t *testing.T, status int) {
 	}))
 	defer ts.Close()
 
-	r, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(r)
-	// make sure we're not getting memcached results
-	if err := memcache.Flush(ctx); err != nil {
-		t.Fatal(err)
-	}
-
-	stor := &Storage{Base: ts.URL, Index: "index.html"}
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Index: "index.html", Cache: NewLRU(1 << 20)}
 	o, err := stor.OpenFile(ctx, "bucket", "/no/slash")
 	if err != nil {
 		t.Fatalf("stor.OpenFile: %v", err)
@@ -118,14 +107,8 @@ func TestOpenAndCache(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	r, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(r)
-	// make sure we're not getting memcached results
-	if err := memcache.Flush(ctx); err != nil {
-		t.Fatal(err)
-	}
-
-	stor := &Storage{Base: ts.URL}
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
 	o, err := stor.Open(ctx, "bucket", "/file.json")
 	if err != nil {
 		t.Fatalf("stor.Open: %v", err)
@@ -142,10 +125,10 @@ func TestOpenAndCache(t *testing.T) {
 		t.Errorf("o.Meta = %+v; want %+v", o.Meta, meta)
 	}
 
-	key := stor.CacheKey("bucket", "/file.json")
-	var ob objectBuf
-	if _, err := memcache.Gob.Get(ctx, key, &ob); err != nil {
-		t.Fatalf("memcache.Gob.Get(%q): %v", key, err)
+	key := stor.objectKey(ctx, "bucket", "/file.json")
+	ob, err := stor.getCache(ctx, key)
+	if err != nil {
+		t.Fatalf("stor.getCache(%q): %v", key, err)
 	}
 	if string(ob.Body) != body {
 		t.Errorf("ob.Body = %q; want %q", ob.Body, body)
@@ -156,9 +139,11 @@ func TestOpenAndCache(t *testing.T) {
 }
 
 func TestOpenFromCache(t *testing.T) {
-	r, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(r)
-	stor := &Storage{Base: "invalid"} // make sure we don't hit real GCS
+	ctx := context.Background()
+	stor := &Storage{
+		Base:  "invalid", // make sure we don't hit real GCS
+		Cache: NewLRU(1 << 20),
+	}
 	ob := &objectBuf{
 		Meta: map[string]string{
 			"content-type":  "text/html",
@@ -166,13 +151,7 @@ func TestOpenFromCache(t *testing.T) {
 		},
 		Body: []byte("cached file"),
 	}
-	item := memcache.Item{
-		Key:    stor.CacheKey("bucket", "TestOpenFromCache"),
-		Object: ob,
-	}
-	if err := memcache.Gob.Set(ctx, &item); err != nil {
-		t.Fatal(err)
-	}
+	stor.setCache(ctx, stor.objectKey(ctx, "bucket", "TestOpenFromCache"), ob, time.Minute)
 
 	o, err := stor.Open(ctx, "bucket", "TestOpenFromCache")
 	if err != nil {
@@ -197,9 +176,8 @@ func TestOpenErr(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	req, _ := testInstance.NewRequest("GET", "/", nil)
-	ctx := appengine.NewContext(req)
-	stor := &Storage{Base: ts.URL}
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
 	obj, err := stor.OpenFile(ctx, "bucket", "TestOpenErr")
 	if err == nil {
 		defer obj.Body.Close()
@@ -213,3 +191,173 @@ func TestOpenErr(t *testing.T) {
 		t.Errorf("errf.Code = %d; want %d", errf.Code, http.StatusBadRequest)
 	}
 }
+
+func TestCacheTTL(t *testing.T) {
+	stor := &Storage{
+		MinCacheTTL: time.Minute,
+		MaxCacheTTL: time.Hour,
+	}
+	tests := []struct {
+		cc  string
+		ttl time.Duration
+	}{
+		{"", time.Hour},
+		{"public", time.Hour},
+		{"public, max-age=600", 10 * time.Minute},
+		{"public, max-age=600, s-maxage=1200", 20 * time.Minute},
+		{`max-age="300"`, 5 * time.Minute},
+		{"max-age=1", time.Minute},
+		{"max-age=0", 0},
+		{"s-maxage=0, max-age=600", 0},
+		{"max-age=86400", time.Hour},
+		{"max-age=invalid", time.Hour},
+		{"no-cache", 0},
+		{"no-cache, max-age=600", 0},
+		{"no-store", 0},
+		{"Private, max-age=600", 0},
+	}
+	for _, test := range tests {
+		meta := map[string]string{"cache-control": test.cc}
+		if v := stor.cacheTTL(meta); v != test.ttl {
+			t.Errorf("cacheTTL(%q) = %v; want %v", test.cc, v, test.ttl)
+		}
+	}
+
+	stor = &Storage{}
+	if v := stor.cacheTTL(nil); v != defaultCacheTTL {
+		t.Errorf("cacheTTL(nil) = %v; want %v", v, defaultCacheTTL)
+	}
+	if v := stor.cacheTTL(map[string]string{"cache-control": "max-age=0"}); v != 0 {
+		t.Errorf("cacheTTL(max-age=0) = %v; want 0", v)
+	}
+}
+
+func TestOpenNoStore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("cache-control", "no-store")
+		w.Write([]byte("secret"))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
+	o, err := stor.Open(ctx, "bucket", "secret.txt")
+	if err != nil {
+		t.Fatalf("stor.Open: %v", err)
+	}
+	ioutil.ReadAll(o.Body)
+	o.Body.Close()
+	key := stor.objectKey(ctx, "bucket", "secret.txt")
+	if _, err := stor.Cache.Get(ctx, key); err != ErrCacheMiss {
+		t.Errorf("stor.Cache.Get(%q): %v; want ErrCacheMiss", key, err)
+	}
+}
+
+func TestOpenRevalidate(t *testing.T) {
+	const etag = `"v1"`
+	var fetches, notModified int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Header.Get("if-none-match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("etag", etag)
+		w.Header().Set("cache-control", "max-age=60")
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Cache: NewLRU(1 << 20)}
+	read := func() string {
+		o, err := stor.Open(ctx, "bucket", "file.txt")
+		if err != nil {
+			t.Fatalf("stor.Open: %v", err)
+		}
+		defer o.Body.Close()
+		b, _ := ioutil.ReadAll(o.Body)
+		return string(b)
+	}
+	if v := read(); v != "contents" {
+		t.Errorf("read() = %q; want contents", v)
+	}
+
+	// expire cached object
+	key := stor.objectKey(ctx, "bucket", "file.txt")
+	ob, err := stor.getCache(ctx, key)
+	if err != nil {
+		t.Fatalf("stor.getCache: %v", err)
+	}
+	ob.Expires = time.Now().Add(-time.Second)
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(ob)
+	stor.Cache.Set(ctx, key, buf.Bytes(), time.Hour)
+
+	if v := read(); v != "contents" {
+		t.Errorf("read() = %q; want contents", v)
+	}
+	if fetches != 2 || notModified != 1 {
+		t.Errorf("fetches = %d, notModified = %d; want 2 and 1", fetches, notModified)
+	}
+	// refreshed
+	if ob, _ = stor.getCache(ctx, key); !ob.fresh() {
+		t.Errorf("ob.Expires = %v; want fresh", ob.Expires)
+	}
+	if v := read(); v != "contents" {
+		t.Errorf("read() = %q; want contents", v)
+	}
+	if fetches != 2 {
+		t.Errorf("fetches = %d; want 2", fetches)
+	}
+}
+
+func TestOpenRewrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/alias.html":
+			w.Header().Set("x-goog-meta-rewrite", "/pages/real.html")
+		case "/bucket/pages/rel":
+			w.Header().Set("x-goog-meta-rewrite", "real.html")
+		case "/bucket/docs":
+			w.Header().Set("x-goog-meta-rewrite", "../docs/v2/")
+		case "/bucket/loop":
+			w.Header().Set("x-goog-meta-rewrite", "loop")
+		case "/bucket/redir":
+			w.Header().Set("x-goog-meta-rewrite", "pages/real.html")
+			w.Header().Set("x-goog-meta-redirect", "/elsewhere")
+		case "/bucket/pages/real.html", "/bucket/docs/v2/index.html":
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	stor := &Storage{Base: ts.URL, Index: "index.html", Cache: NewLRU(1 << 20)}
+	tests := []struct{ name, body string }{
+		{"alias.html", "/bucket/pages/real.html"},
+		{"pages/rel", "/bucket/pages/real.html"},
+		{"docs", "/bucket/docs/v2/index.html"},
+		{"redir", ""},
+	}
+	for _, test := range tests {
+		o, err := stor.Open(ctx, "bucket", test.name)
+		if err != nil {
+			t.Errorf("stor.Open(%q): %v", test.name, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(o.Body)
+		o.Body.Close()
+		if string(b) != test.body {
+			t.Errorf("stor.Open(%q): body = %q; want %q", test.name, b, test.body)
+		}
+	}
+
+	_, err := stor.Open(ctx, "bucket", "loop")
+	if ferr, ok := err.(*FetchError); !ok || ferr.Code != http.StatusLoopDetected {
+		t.Errorf("stor.Open(loop): %v; want FetchError %d", err, http.StatusLoopDetected)
+	}
+}